@@ -3,6 +3,8 @@ package psbahandlers
 import (
 	"database/sql"
 	"fmt"
+	"math/rand"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,8 +14,22 @@ import (
 
 func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *core.HandlerLogger) (*core.RadiusPacket, error) {
 
+	trace := newDecisionTrace(ctx)
+	response, err := decideAccess(request, ctx, trace, hl)
+	trace.complete(response, err)
+	decisionTraces.Add(trace)
+
+	return response, err
+}
+
+// Composes the response to the Access-Request, recording the decisions taken in the trace
+func decideAccess(request *core.RadiusPacket, ctx *RequestContext, trace *DecisionTrace, hl *core.HandlerLogger) (*core.RadiusPacket, error) {
+
 	var err error
 	now := time.Now()
+	if ctx.evaluation != nil && !ctx.evaluation.Time.IsZero() {
+		now = ctx.evaluation.Time
+	}
 
 	// For logging
 	l := hl.L
@@ -27,16 +43,30 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 	var planName string
 	// Attributes from upstream server. Initially empty
 	var proxyRadiusAttrs = make([]core.RadiusAVP, 0)
+	// If not zero, the Session-Timeout to send will not be higher than this value
+	var maxSessionTimeout int
+	var sessionTimeoutReason string
+	// Expiration dates of the overrides that set the basic profile and the addon in effect, and the corresponding
+	// overrides. Zero if not set by an override that expires. An override replaced by another one does not count
+	var basicExpiry, addonExpiry time.Time
+	var basicExpiryReason, addonExpiryReason string
+	// If not empty, overrides the Reply-Message
+	var replyMessage string
 
 	// Find the user
 	var clientpou ClientPoU
-	if ctx.config.ProvisionType == "database" {
+	if ctx.evaluation != nil && ctx.evaluation.Client != nil {
+		trace.LookupKey = "evaluation client"
+		clientpou = *ctx.evaluation.Client
+	} else if ctx.config.ProvisionType == "database" {
+		trace.LookupKey = fmt.Sprintf("database accessId=%s accessPort=%d", ctx.accessId, ctx.accessPort)
 		clientpou, err = findDBClient(ctx.userName, ctx.accessPort, ctx.accessId, hl)
 		if err != nil {
 			// No answer
 			return nil, err
 		}
 	} else if ctx.config.ProvisionType == "file" {
+		trace.LookupKey = "file userName=" + ctx.userName
 		// Uses username to find the user in the specialUsers config file
 		userEntry, found := specialUsers.Get()[ctx.userName]
 		if found {
@@ -46,6 +76,27 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 			clientpou.UserName = ctx.userName
 			clientpou.PlanName = userEntry.CheckItems["planName"]
 			clientpou.ExternalClientId = userEntry.CheckItems["externalClientId"]
+			clientpou.ISP = userEntry.CheckItems["isp"]
+			clientpou.Parameters = userEntry.CheckItems["parameters"]
+			clientpou.IPv4Address = userEntry.CheckItems["ipv4Address"]
+			clientpou.IPv6DelegatedPrefix = userEntry.CheckItems["ipv6DelegatedPrefix"]
+			clientpou.IPv6WANPrefix = userEntry.CheckItems["ipv6WANPrefix"]
+			if at := userEntry.CheckItems["accessType"]; at != "" {
+				if clientpou.AccessType, err = strconv.Atoi(at); err != nil {
+					// Rejected afterwards
+					clientpou.AccessType = -1
+				}
+			}
+			if bs := userEntry.CheckItems["blockingStatus"]; bs != "" {
+				if clientpou.BlockingStatus, err = strconv.Atoi(bs); err != nil {
+					l.Errorf("bad blocking status %s for %s", bs, ctx.userName)
+				}
+			}
+			if bc := userEntry.CheckItems["billingCycle"]; bc != "" {
+				if clientpou.BillingCycle, err = strconv.Atoi(bc); err != nil {
+					l.Errorf("bad billing cycle %s for %s", bc, ctx.userName)
+				}
+			}
 
 			// Add radius attributes
 			if core.IsDebugEnabled() {
@@ -59,6 +110,16 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 		return nil, fmt.Errorf("unknown provision type %s", ctx.config.ProvisionType)
 	}
 
+	// Parameters specific of the client, that override those of the plan
+	var clientParams PlanTemplateParams
+	if clientpou.Parameters != "" {
+		if clientParams, err = basicProfiles.ParseClientParameters(clientpou.Parameters); err != nil {
+			l.Warnf("ignoring bad parameters %s for client %s: %s", clientpou.Parameters, clientpou.ExternalClientId, err)
+		} else {
+			l.Debugf("client parameters %v", clientParams)
+		}
+	}
+
 	// Set the plan name, which may be overriden later
 	planName = clientpou.PlanName
 	// If the user has a plan, let's assign here the initial basic profile
@@ -69,6 +130,19 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 	// Actions if user not found
 	if clientpou.ClientId != 0 {
 		l.Debugf("client found %#v\n", clientpou)
+		trace.ClientFound = true
+		trace.ExternalClientId = clientpou.ExternalClientId
+		trace.ClientPlanName = clientpou.PlanName
+		trace.BlockingStatus = clientpou.BlockingStatus
+
+		// Configuration of the wholesale ISP
+		if clientpou.ISP != "" {
+			if ctx.applyISP(clientpou.ISP, hl) {
+				trace.addOverride("isp %s configuration", clientpou.ISP)
+			} else {
+				l.Debugf("no configuration for isp %s", clientpou.ISP)
+			}
+		}
 	} else {
 		l.Debug("client not found\n")
 		// If permissiveProfile is defined, we assign that one. Otherwise, signal rejection
@@ -78,6 +152,7 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 			clientpou.AccessPort = ctx.accessPort
 			clientpou.UserName = ctx.userName
 			basicProfile = ctx.config.PermissiveProfile
+			trace.addOverride("permissive profile %s", basicProfile)
 		} else {
 			rejectReason = "client not found"
 		}
@@ -123,60 +198,109 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 		return nil, fmt.Errorf("bad authlocal type <%s>", ctx.config.AuthLocal)
 	}
 
+	// Not defaulting to dual stack, which could assign addresses of an IP version not supported by the line
+	if rejectReason == "" && !validAccessType(clientpou.AccessType) {
+		l.Errorf("bad access type %d for %s", clientpou.AccessType, ctx.userName)
+		rejectReason = fmt.Sprintf("bad access type %d", clientpou.AccessType)
+	}
+
 	if rejectReason == "" {
 		// Apply overrides and calculate basic service and addon
 		// Priorities are (from low to high)
-		// PlanOverride --> Notification  --> Addon Override --> blocked --> realmOverride (--> rejectOverrides)
+		// PlanOverride --> Notification  --> Addon Override --> Quota --> blocked --> realmOverride (--> rejectOverrides)
 
 		// Plan override
 		if clientpou.PlanOverrideExpDate.After(now) && clientpou.PlanOverride != "" {
 			planName = clientpou.PlanOverride
+			basicExpiry, basicExpiryReason = clientpou.PlanOverrideExpDate, "planOverride"
 			l.Debugf("overriding plan to <%s>", planName)
+			trace.addOverride("plan override %s until %s", planName, clientpou.PlanOverrideExpDate.Format(time.RFC3339))
 		}
 
 		// Notification overrides
 		if clientpou.NotificationExpDate.After(now) {
 			if ctx.config.NotificationIsAddon {
 				addonProfile = ctx.config.NotificationProfile
+				addonExpiry, addonExpiryReason = clientpou.NotificationExpDate, "notification"
 				l.Debugf("applying notification addon <%s>", addonProfile)
+				trace.addOverride("notification addon %s until %s", addonProfile, clientpou.NotificationExpDate.Format(time.RFC3339))
 			} else {
 				basicProfile = ctx.config.NotificationProfile
 				addonProfile = ""
+				basicExpiry, basicExpiryReason = clientpou.NotificationExpDate, "notification"
+				addonExpiry, addonExpiryReason = time.Time{}, ""
 				l.Debugf("applying notification basic profile <%s> and deleting addon profile", basicProfile)
+				trace.addOverride("notification basic profile %s until %s", basicProfile, clientpou.NotificationExpDate.Format(time.RFC3339))
 			}
 		}
 
 		// Addon override
 		if clientpou.AddonProfileOverrideExpDate.After(now) && clientpou.AddonProfileOverride != "" {
 			addonProfile = clientpou.AddonProfileOverride
+			addonExpiry, addonExpiryReason = clientpou.AddonProfileOverrideExpDate, "addonOverride"
 			l.Debugf("applying client addon <%s>", addonProfile)
+			trace.addOverride("addon override %s until %s", addonProfile, clientpou.AddonProfileOverrideExpDate.Format(time.RFC3339))
+		}
+
+		// Quota. Checked in each Access-Request, so that reconnecting does not remove the addon
+		if quota := basicProfiles.GetQuota(planName); quota != nil && clientpou.ExternalClientId != "" {
+			cycleStart, cycleEnd := billingCycle(now, clientpou.BillingCycle)
+			if usage, err := readCycleUsage(clientpou.ExternalClientId, cycleStart, cycleEnd); err != nil {
+				l.Errorf("could not get usage of client %s: %s", clientpou.ExternalClientId, err)
+			} else if threshold, found := quota.addonThreshold(quota.level(usage.InputOctets + usage.OutputOctets)); found {
+				addonProfile = threshold.AddonProfile
+				addonExpiry, addonExpiryReason = cycleEnd, "quota"
+				l.Debugf("applying quota addon <%s>", addonProfile)
+				trace.addOverride("quota %d%% addon %s until %s", threshold.Percent, addonProfile, cycleEnd.Format(time.RFC3339))
+			}
 		}
 
 		// Blocking overrides
-		if clientpou.BlockingStatus == 2 {
-			if ctx.config.BlockingProfile != "" {
-				if ctx.config.BlockingIsAddon {
-					addonProfile = ctx.config.BlockingProfile
+		if blocking, isBlocked := ctx.config.GetBlockingStatus(clientpou.BlockingStatus); isBlocked {
+			l.Debugf("blocking status %d <%s>", clientpou.BlockingStatus, blocking.Name)
+			if blocking.Profile != "" {
+				if blocking.IsAddon {
+					addonProfile = blocking.Profile
+					addonExpiry, addonExpiryReason = time.Time{}, ""
 					l.Debugf("applying blocking addon <%s>", addonProfile)
+					trace.addOverride("blocking status %d (%s) addon %s", clientpou.BlockingStatus, blocking.Name, addonProfile)
 				} else {
-					basicProfile = ctx.config.BlockingProfile
+					basicProfile = blocking.Profile
 					addonProfile = ""
+					basicExpiry, basicExpiryReason = time.Time{}, ""
+					addonExpiry, addonExpiryReason = time.Time{}, ""
 					l.Debugf("applying blocking basic profile <%s> and deleting addon profile", basicProfile)
+					trace.addOverride("blocking status %d (%s) basic profile %s", clientpou.BlockingStatus, blocking.Name, basicProfile)
 				}
+				maxSessionTimeout = blocking.SessionTimeoutSeconds
+				sessionTimeoutReason = "blocking"
+				replyMessage = blocking.ReplyMessage
 			} else {
 				// If no blocking profile, reject user
-				rejectReason = "blocked user"
+				if blocking.ReplyMessage != "" {
+					rejectReason = blocking.ReplyMessage
+				} else {
+					rejectReason = "blocked user"
+				}
+				trace.addOverride("blocking status %d (%s) reject", clientpou.BlockingStatus, blocking.Name)
 			}
+		} else if clientpou.BlockingStatus != 0 {
+			l.Warnf("ignoring unknown blocking status %d", clientpou.BlockingStatus)
 		}
 		// Realm override
 		if ctx.config.RealmProfile != "" {
 			basicProfile = ctx.config.RealmProfile
 			addonProfile = ""
+			basicExpiry, basicExpiryReason = time.Time{}, ""
+			addonExpiry, addonExpiryReason = time.Time{}, ""
 			l.Debugf("applying realm basic profile <%s>", basicProfile)
+			trace.addOverride("realm basic profile %s", basicProfile)
 		}
 
 		// Proxy
-		if ctx.config.ProxyGroupName != "" && ctx.config.ProxyGroupName != "none" {
+		if ctx.evaluation != nil && ctx.config.ProxyGroupName != "" && ctx.config.ProxyGroupName != "none" {
+			trace.ProxyOutcome = "not proxied to " + ctx.config.ProxyGroupName + " in evaluation"
+		} else if ctx.config.ProxyGroupName != "" && ctx.config.ProxyGroupName != "none" {
 
 			// Filter
 			proxyRequest, err := radiusFilters.FilteredPacket(request, ctx.config.AuthProxyFilterOut)
@@ -198,11 +322,13 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 			if err != nil {
 				l.Debugf("proxy error %s", err)
 				if !ctx.config.AcceptOnProxyError {
+					trace.ProxyOutcome = fmt.Sprintf("error from %s: %s", ctx.config.ProxyGroupName, err)
 					return nil, fmt.Errorf("proxy error: %w", err)
 				} else {
 					// Fake, accept, empty radius response
 					proxyReply = core.NewRadiusResponse(request, true)
 					l.Debugf("ingoring proxy error %w", err)
+					trace.ProxyOutcome = fmt.Sprintf("ignored error from %s: %s", ctx.config.ProxyGroupName, err)
 				}
 			} else {
 				l.Debugf("proxy reply: %s", proxyReply)
@@ -212,6 +338,9 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 			if proxyReply.Code == core.ACCESS_REJECT {
 				l.Debug("access reject")
 				rejectReason = "rejected by upstream radius: " + proxyReply.GetStringAVP("Reply-Message")
+				if trace.ProxyOutcome == "" {
+					trace.ProxyOutcome = "reject from " + ctx.config.ProxyGroupName
+				}
 			} else {
 				// Access Accept
 				l.Debug("access accept")
@@ -221,12 +350,17 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 				}
 				proxyRadiusAttrs = filteredProxyReply.AVPs
 				l.Debugf("filtered proxy reply attributes: %s", proxyRadiusAttrs)
+				if trace.ProxyOutcome == "" {
+					trace.ProxyOutcome = fmt.Sprintf("accept from %s with %d attributes", ctx.config.ProxyGroupName, len(proxyRadiusAttrs))
+				}
 			}
 		}
 	}
 
 	// Reject overrides or reject reply
 	if rejectReason != "" {
+		trace.RejectReason = rejectReason
+
 		// Just a normal reject
 		if ctx.config.RejectProfile == "" {
 			l.Debugf("sending reject with reason %s", rejectReason)
@@ -239,12 +373,34 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 		l.Debugf("applying reject basic profile <%s>", basicProfile)
 		basicProfile = ctx.config.RejectProfile
 		addonProfile = ""
+		trace.addOverride("reject profile %s", basicProfile)
+		// The blocking treatment and overrides, if any, do not apply
+		maxSessionTimeout = 0
+		replyMessage = ""
+		basicExpiry, addonExpiry = time.Time{}, time.Time{}
+	}
+
+	// Make the user re-authenticate after the overrides in effect expire
+	nextExpiry, nextExpiryReason := earliestExpiry(basicExpiry, basicExpiryReason, addonExpiry, addonExpiryReason)
+	if ctx.config.AlignSessionTimeoutToExpiry && !nextExpiry.IsZero() {
+		seconds := int(nextExpiry.Sub(now).Seconds()) + 1
+		if ctx.config.SessionTimeoutJitterSeconds > 0 {
+			seconds += rand.Intn(ctx.config.SessionTimeoutJitterSeconds + 1)
+		}
+		if maxSessionTimeout == 0 || seconds < maxSessionTimeout {
+			maxSessionTimeout = seconds
+			sessionTimeoutReason = nextExpiryReason
+		}
+		l.Debugf("%s expires at %s", nextExpiryReason, nextExpiry)
 	}
 
 	// Compose final response
 
 	// Get the basic profile radius attributes
 	l.Debugf("composing final response with plan <%s> basicProfile <%s> and addonProfile <%s>", planName, basicProfile, addonProfile)
+	trace.PlanName = planName
+	trace.BasicProfile = basicProfile
+	trace.AddonProfile = addonProfile
 
 	var basicProfileRadiusAttrs handler.AVPItems
 	var basicProfileNoRadiusAttrs handler.AVPItems
@@ -252,17 +408,25 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 
 	if basicProfile == standardBasicProfileName && planName != "" {
 		// If the basic profile is that of the Internet service, take the parametrization from the basicProfiles
-		basicProfileForPlan, err := basicProfiles.GetKey(planName)
+		basicProfileForPlan, err := basicProfiles.GetKeyForClient(planName, clientParams)
+		if err != nil && len(clientParams) > 0 {
+			l.Warnf("ignoring parameters for client %s: %s", clientpou.ExternalClientId, err)
+			basicProfileForPlan, err = basicProfiles.GetKey(planName)
+		}
 		if err != nil {
 			l.Errorf("plan %s not found", planName)
 			return nil, fmt.Errorf("plan %s not found", planName)
 		}
-		basicProfileRadiusAttrs = basicProfileForPlan[standardBasicProfileName].ReplyItems
-		basicProfileNoRadiusAttrs = basicProfileForPlan[standardBasicProfileName].NonOverridableReplyItems
+		basicProfileRadiusAttrs, basicProfileNoRadiusAttrs, err = basicProfileForPlan[standardBasicProfileName].ItemsForClientType(ctx.radiusClientType)
+		if err != nil {
+			return nil, fmt.Errorf("could not get attributes for plan %s: %w", planName, err)
+		}
 	} else {
 		// basic profile was overriden due to some special condition
-		basicProfileRadiusAttrs = profiles.Get()[basicProfile].ReplyItems
-		basicProfileNoRadiusAttrs = profiles.Get()[basicProfile].NonOverridableReplyItems
+		basicProfileRadiusAttrs, basicProfileNoRadiusAttrs, err = profiles.Get()[basicProfile].ItemsForClientType(ctx.radiusClientType)
+		if err != nil {
+			return nil, fmt.Errorf("could not get attributes for profile %s: %w", basicProfile, err)
+		}
 	}
 
 	// Get the addon profile radius attributes
@@ -272,8 +436,10 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 		if addon, found := profiles.Get()[addonProfile]; !found {
 			return nil, fmt.Errorf("addon profile not found %s", addonProfile)
 		} else {
-			addonProfileRadiusAttrs = addon.ReplyItems
-			addonProfileNoRadiusAttrs = addon.ReplyItems
+			addonProfileRadiusAttrs, addonProfileNoRadiusAttrs, err = addon.ItemsForClientType(ctx.radiusClientType)
+			if err != nil {
+				return nil, fmt.Errorf("could not get attributes for addon profile %s: %w", addonProfile, err)
+			}
 		}
 	}
 
@@ -285,40 +451,167 @@ func AccessRequestHandler(request *core.RadiusPacket, ctx *RequestContext, hl *c
 		l.Debugf("addon profile no attributes: %s", addonProfileNoRadiusAttrs)
 	}
 
-	// Merge
-	radiusAttributes := ctx.radiusAttributes.OverrideWith(basicProfileRadiusAttrs).OverrideWith(addonProfileRadiusAttrs).OverrideWith(proxyRadiusAttrs)
+	// Merge the locally configured attributes
+	radiusAttributes := ctx.radiusAttributes.OverrideWith(basicProfileRadiusAttrs).OverrideWith(addonProfileRadiusAttrs)
 	noRadiusAttributes := ctx.noRadiusAttributes.Add(basicProfileNoRadiusAttrs).Add(addonProfileNoRadiusAttrs)
 
-	// Compose and add class attribute
-	classAttrs := []string{fmt.Sprintf("P:%s", planName), fmt.Sprintf("C:%s", clientpou.ExternalClientId)}
-	if addonProfile != "" {
-		classAttrs = append(classAttrs, fmt.Sprintf("A:%s", addonProfile))
-	}
-	classRadiusAVP, _ := core.NewRadiusAVP("Class", strings.Join(classAttrs, "#"))
+	// Render the templated attributes with the parameters of the plan and the client, and expand the request variables.
+	// Done before adding the attributes from the upstream server, whose values are never rendered
+	templateParams := basicProfiles.MergedParameters(planName, clientParams)
+	variables := RequestVariables{request: request, realm: ctx.realm, planName: planName, client: &clientpou}
+	radiusAttributes = renderReplyItems(radiusAttributes, templateParams, &variables, hl)
+	noRadiusAttributes = renderReplyItems(noRadiusAttributes, templateParams, &variables, hl)
+
+	// Attributes from the upstream server
+	radiusAttributes = handler.AVPItems(radiusAttributes).OverrideWith(proxyRadiusAttrs)
+
+	// Do not send attributes specific of other vendors
+	radiusAttributes = radiusClientTypes.Get().FilterForeignAttributes(ctx.radiusClientType, radiusAttributes)
+	noRadiusAttributes = radiusClientTypes.Get().FilterForeignAttributes(ctx.radiusClientType, noRadiusAttributes)
 
 	// Build the response
 	response := core.NewRadiusResponse(request, true).
 		AddAVPs(radiusAttributes).
-		AddAVPs(noRadiusAttributes).
-		AddAVP(classRadiusAVP)
+		AddAVPs(noRadiusAttributes)
 
 	// Add the Fixed IP addresses if necessary
 	if clientpou.IPv4Address != "" {
 		response.Add("Framed-IP-Address", clientpou.IPv4Address)
 	}
 	if clientpou.IPv6DelegatedPrefix != "" {
-		response.Add("Delegated-IPv6-Prefix", clientpou.IPv6DelegatedPrefix)
+		if prefix, err := parseIPv6Prefix(clientpou.IPv6DelegatedPrefix); err != nil {
+			l.Errorf("ignoring bad delegated prefix %s: %s", clientpou.IPv6DelegatedPrefix, err)
+		} else {
+			response.Add("Delegated-IPv6-Prefix", prefix.String())
+		}
+	}
+	if clientpou.IPv6WANPrefix != "" {
+		if prefix, interfaceId, err := parseWANPrefix(clientpou.IPv6WANPrefix); err != nil {
+			l.Errorf("ignoring bad WAN prefix %s: %s", clientpou.IPv6WANPrefix, err)
+		} else {
+			response.Add("Framed-IPv6-Prefix", prefix)
+			if interfaceId != "" {
+				response.Add("Framed-Interface-Id", interfaceId)
+			}
+		}
+	}
+
+	// Assign addresses from the local pools, if not already assigned, unless the reject profile was assigned.
+	// The addresses are released if the Access-Accept is not finally sent, since the lease would not be confirmed
+	var allocated []string
+	releaseAllocated := func() {
+		for _, address := range allocated {
+			ipam.ReleaseUnconfirmed(ctx.accessLine(), address)
+		}
+	}
+	if pool := selectLocalPool(ctx.config.LocalIPv4Pool, templateParams["LocalIPv4Pool"]); pool != "" && rejectReason == "" && clientpou.AccessType != accessTypeIPv6Only && len(response.GetAllAVP("Framed-IP-Address")) == 0 {
+		if ctx.evaluation != nil {
+			trace.addOverride("address from pool %s not assigned in evaluation", pool)
+		} else {
+			address, err := ipam.Allocate(pool, ctx.accessLine(), ctx.userName)
+			if err != nil {
+				return nil, fmt.Errorf("could not assign address: %w", err)
+			}
+			allocated = append(allocated, address)
+			l.Debugf("assigned address %s from pool %s", address, pool)
+			trace.addOverride("address %s from pool %s", address, pool)
+			response.Add("Framed-IP-Address", address)
+		}
+	}
+	if pool := selectLocalPool(ctx.config.LocalIPv6PrefixPool, templateParams["LocalIPv6PrefixPool"]); pool != "" && rejectReason == "" && clientpou.AccessType != accessTypeIPv4Only && len(response.GetAllAVP("Delegated-IPv6-Prefix")) == 0 {
+		if ctx.evaluation != nil {
+			trace.addOverride("delegated prefix from pool %s not assigned in evaluation", pool)
+		} else {
+			prefix, err := ipam.Allocate(pool, ctx.accessLine(), ctx.userName)
+			if err != nil {
+				releaseAllocated()
+				return nil, fmt.Errorf("could not assign delegated prefix: %w", err)
+			}
+			allocated = append(allocated, prefix)
+			l.Debugf("assigned delegated prefix %s from pool %s", prefix, pool)
+			trace.addOverride("delegated prefix %s from pool %s", prefix, pool)
+			response.Add("Delegated-IPv6-Prefix", prefix)
+		}
 	}
 
+	// Tunnel to the L2TP Network Servers, unless the reject profile was assigned
+	if ctx.config.LNSSet != "" && rejectReason == "" {
+		tunnelAttrs, err := lnsManager.TunnelAttributes(ctx.config.LNSSet)
+		if err != nil {
+			releaseAllocated()
+			return nil, fmt.Errorf("could not assign tunnel: %w", err)
+		}
+		response.AddAVPs(tunnelAttrs)
+		trace.addOverride("tunnel to lns set %s", ctx.config.LNSSet)
+	}
+
+	// Do not send attributes for IP versions not used by the access line
+	filterByAccessType(response, clientpou.AccessType)
+
+	if maxSessionTimeout > 0 {
+		if capSessionTimeout(response, maxSessionTimeout) {
+			l.Debugf("Session-Timeout set to %d due to %s", maxSessionTimeout, sessionTimeoutReason)
+			trace.addOverride("Session-Timeout %d due to %s", maxSessionTimeout, sessionTimeoutReason)
+		} else {
+			sessionTimeoutReason = ""
+		}
+	}
+	if replyMessage != "" {
+		response.Replace("Reply-Message", replyMessage)
+	}
+
+	// Compose and add class attribute
+	classInfo := ClassInfo{
+		PlanName:             planName,
+		ExternalClientId:     clientpou.ExternalClientId,
+		ISP:                  ctx.isp,
+		AddonProfile:         addonProfile,
+		SessionTimeoutReason: sessionTimeoutReason,
+	}
+	class, complete := classCodec.Encode(classInfo)
+	if !complete {
+		l.Warnf("Class truncated to %s for client %s", class, clientpou.ExternalClientId)
+		incrementCounter("classTruncated", planName)
+	}
+	response.Add("Class", class)
+
 	l.Debugf(response.String())
 
 	return response, nil
 }
 
+// Returns the local pool to use. The one specified in the plan parameters, if any, takes precedence
+// over the one in the configuration
+func selectLocalPool(configPool string, planPool any) string {
+	if p, ok := planPool.(string); ok && p != "" {
+		return p
+	}
+	return configPool
+}
+
+// Sets the Session-Timeout in the response to the specified value, unless already lower.
+// Returns true if the value was modified
+func capSessionTimeout(response *core.RadiusPacket, seconds int) bool {
+	if current := response.GetIntAVP("Session-Timeout"); current == 0 || current > int64(seconds) {
+		response.Replace("Session-Timeout", seconds)
+		return true
+	}
+	return false
+}
+
+// Returns the earliest of the expiration dates, with the corresponding reason. Zero dates are ignored
+func earliestExpiry(current time.Time, currentReason string, candidate time.Time, candidateReason string) (time.Time, string) {
+	if current.IsZero() || (!candidate.IsZero() && candidate.Before(current)) {
+		return candidate, candidateReason
+	}
+	return current, currentReason
+}
+
 type NullableClientPoU struct {
 	ClientId                    int
 	ExternalClientId            string
 	ISP                         sql.NullString
+	BillingCycle                sql.NullInt32
 	PlanName                    string
 	BlockingStatus              int
 	PlanOverride                sql.NullString
@@ -343,6 +636,7 @@ func (p *NullableClientPoU) toPoU() ClientPoU {
 		ClientId:                    p.ClientId,
 		ExternalClientId:            p.ExternalClientId,
 		ISP:                         p.ISP.String,
+		BillingCycle:                int(p.BillingCycle.Int32),
 		PlanName:                    p.PlanName,
 		BlockingStatus:              p.BlockingStatus,
 		PlanOverride:                p.PlanOverride.String,
@@ -377,6 +671,7 @@ func findDBClient(userName string, accessPort int64, accessId string, hl *core.H
 	clients.ClientId, 
 	ExternalClientId, 
 	ISP, 
+	BillingCycle,
 	PlanName, 
 	BlockingStatus, 
 	PlanOverride, 
@@ -400,6 +695,7 @@ func findDBClient(userName string, accessPort int64, accessId string, hl *core.H
 		&clientpou.ClientId,
 		&clientpou.ExternalClientId,
 		&clientpou.ISP,
+		&clientpou.BillingCycle,
 		&clientpou.PlanName,
 		&clientpou.BlockingStatus,
 		&clientpou.PlanOverride,
@@ -1,6 +1,7 @@
 package psbahandlers
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -14,6 +15,19 @@ func AccountingRequestHandler(request *core.RadiusPacket, ctx *RequestContext, h
 	l.Debug("start processing accounting request")
 	l.Debug(request.String())
 
+	// Retransmissions are acknowledged without further treatment, once the first copy has been answered.
+	// Those received while the first copy is being processed are dropped, and thus also counted by igor in
+	// radius_server_drops. The duplicateAccounting counter is exported in /metrics as psba_duplicate_accounting
+	switch duplicateDetector.Check(request, time.Now()) {
+	case duplicateStatusAnswered:
+		l.Debug("duplicate accounting request")
+		incrementCounter("duplicateAccounting", request.GetStringAVP("Acct-Status-Type"))
+		return core.NewRadiusResponse(request, true), nil
+	case duplicateStatusInProcess:
+		incrementCounter("duplicateAccounting", request.GetStringAVP("Acct-Status-Type"))
+		return nil, fmt.Errorf("retransmission of accounting request being processed")
+	}
+
 	// Check Session or Service accounting
 	var serviceName string
 	if ctx.radiusClientType == "SRC" {
@@ -38,19 +52,53 @@ func AccountingRequestHandler(request *core.RadiusPacket, ctx *RequestContext, h
 		l.Debugf("is session accounting")
 	}
 
-	// Write CDR
-	for i, w := range cdrWriters {
-		l.Debugf("checking with <%s>", cdrWriteCheckers[i])
-		if c, found := radiusCheckers[cdrWriteCheckers[i]]; found {
-			if c.CheckPacket(request) {
-				w.WriteRadiusCDR(request)
-				l.Debugf("cdr written")
+	// Add the information encoded in the Class attribute by the access request handler
+	addClassAttributes(request, hl)
+
+	// Configuration of the wholesale ISP, as sent in the Class
+	if isp := request.GetStringAVP("PSA-ISP"); isp != "" && !ctx.applyISP(isp, hl) {
+		l.Debugf("no configuration for isp %s", isp)
+	}
+
+	// Inline proxy. Done before updating the sessions and leases, writing the CDR and copies, so that nothing
+	// is done for the requests not answered, which will be retried by the NAS
+	if ctx.config.ProxyGroupName != "" && ((serviceName != "" && ctx.config.ProxyServiceAccounting) || (serviceName == "" && ctx.config.ProxySessionAccounting)) {
+		l.Debugf("proxy to %s", ctx.config.ProxyGroupName)
+		reqCopy, _ := radiusFilters.FilteredPacket(request, ctx.config.AcctProxyFilterOut)
+		if err := proxyAccounting(reqCopy, ctx); err != nil {
+			l.Warnf("error proxying to %s: %s", ctx.config.ProxyGroupName, err)
+			if ctx.config.AcctProxyMustSucceed {
+				// Otherwise the retransmission would be taken as duplicate
+				duplicateDetector.Forget(request)
+				return nil, fmt.Errorf("accounting not proxied to %s: %w", ctx.config.ProxyGroupName, err)
 			}
-		} else {
-			panic("checker not found: " + cdrWriteCheckers[i])
 		}
 	}
 
+	// The NAS has restarted or is about to, so its sessions are finished. The request is treated
+	// afterwards as any other
+	if statusType := request.GetStringAVP("Acct-Status-Type"); statusType == "Accounting-on" || statusType == "Accounting-off" {
+		closeNASSessions(request, statusType, hl)
+	}
+
+	// Keep track of the leases of locally assigned addresses
+	if serviceName == "" {
+		updateLeases(request, ctx.accessLine(), hl)
+	}
+
+	// Keep track of the active sessions
+	if session := sessionStore.Update(request, ctx, serviceName); session == nil {
+		l.Debugf("session not found")
+	}
+
+	// Write CDR
+	writeCDRs(request, ctx, hl)
+
+	// Session usage in the database
+	if serviceName == "" {
+		accountingSink.Add(request, ctx)
+	}
+
 	// Copy to defined targets
 	for _, ct := range ctx.config.CopyTargets {
 		// Check if the packet should be treated by this target
@@ -62,12 +110,26 @@ func AccountingRequestHandler(request *core.RadiusPacket, ctx *RequestContext, h
 			reqCopy, _ := radiusFilters.FilteredPacket(request, ct.FilterName)
 			l.Debugf("sending radius packet to %s %s", ct.ProxyGroupName, reqCopy)
 
+			// Keep the order of the copies if some are waiting in the spool
+			spool := copySpools[ct.TargetName]
+			if spool != nil && spool.Pending() {
+				if err := spool.Add(reqCopy); err != nil {
+					core.GetLogger().Errorf("could not spool copy to %s: %s", ct.TargetName, err)
+				}
+				continue
+			}
+
 			// Do proxy asycnronously
 			wg.Add(1)
 			go func(ct CopyTarget) {
 				defer wg.Done()
 				if _, err := radiusRouter.RouteRadiusRequest(reqCopy, ct.ProxyGroupName, time.Duration(ct.ProxyTimeoutMillis)*time.Millisecond, 1+ct.ProxyRetries, 1+ct.ProxyServerRetries, ""); err != nil {
 					core.GetLogger().Warnf("error sending copy to %s: %s", ct.ProxyGroupName, err)
+					if spool != nil {
+						if err := spool.Add(reqCopy); err != nil {
+							core.GetLogger().Errorf("could not spool copy to %s: %s", ct.TargetName, err)
+						}
+					}
 				} else {
 					l.Debugf("proxy done")
 				}
@@ -78,17 +140,82 @@ func AccountingRequestHandler(request *core.RadiusPacket, ctx *RequestContext, h
 		}
 	}
 
-	// Inline proxy
-	if ctx.config.ProxyGroupName != "" && ((serviceName != "" && ctx.config.ProxyServiceAccounting) || (serviceName == "" && ctx.config.ProxySessionAccounting)) {
-		l.Debugf("proxy to %s", ctx.config.ProxyGroupName)
-		reqCopy, _ := radiusFilters.FilteredPacket(request, ctx.config.AcctProxyFilterOut)
-		_, err := radiusRouter.RouteRadiusRequest(reqCopy, ctx.config.ProxyGroupName, time.Duration(ctx.config.ProxyTimeoutMillis)*time.Millisecond, 1+ctx.config.ProxyRetries, 1+ctx.config.ProxyServerRetries, "")
-		if err != nil {
-			l.Warn("error proxying to %s: %s", ctx.config.ProxyGroupName, err)
+	response := core.NewRadiusResponse(request, true)
+	duplicateDetector.Answered(request)
+
+	return response, nil
+}
+
+// Writes the accounting request to the CDR writers whose checker matches, skipping those that are
+// only used on demand, if not specified in the configuration
+func writeCDRs(request *core.RadiusPacket, ctx *RequestContext, hl *core.HandlerLogger) {
+
+	l := hl.L
+
+	for i, w := range cdrWriters {
+		if cdrWriterConfigs[i].OnDemand && !ctx.config.UsesCDRWriter(cdrWriterConfigs[i].Name) {
+			continue
+		}
+		l.Debugf("checking with <%s>", cdrWriteCheckers[i])
+		if c, found := radiusCheckers[cdrWriteCheckers[i]]; found {
+			if c.CheckPacket(request) {
+				w.WriteRadiusCDR(request)
+				l.Debugf("cdr written")
+			}
+		} else {
+			panic("checker not found: " + cdrWriteCheckers[i])
 		}
 	}
+}
 
-	response := core.NewRadiusResponse(request, true)
+// Closes all the sessions of the NAS that sent the Accounting-On or Accounting-Off, writing synthetic stops
+func closeNASSessions(request *core.RadiusPacket, statusType string, hl *core.HandlerLogger) {
 
-	return response, nil
+	nasIPAddress := request.GetStringAVP("NAS-IP-Address")
+	nasIdentifier := request.GetStringAVP("NAS-Identifier")
+	if nasIPAddress == "" && nasIdentifier == "" {
+		hl.L.Warnf("%s without NAS-IP-Address or NAS-Identifier", statusType)
+		return
+	}
+
+	reason, terminateCause := "accounting-on", "NAS Reboot"
+	if statusType == "Accounting-off" {
+		reason, terminateCause = "accounting-off", "NAS Request"
+	}
+
+	sessions := sessionStore.RemoveNAS(nasIPAddress, nasIdentifier)
+	for _, session := range sessions {
+		closeSession(session, reason, terminateCause)
+	}
+
+	nas := nasIPAddress
+	if nas == "" {
+		nas = nasIdentifier
+	}
+	raiseEvent("nasRestart", nas, "%s received, %d sessions closed", statusType, len(sessions))
+}
+
+// Sends the accounting request to the inline proxy group. If the proxy must succeed and the requests are to be
+// spooled, the request is stored in the spool of the proxy group when it could not be sent, or when there are
+// older requests in the spool, and the error is not reported
+func proxyAccounting(request *core.RadiusPacket, ctx *RequestContext) error {
+
+	var spool *Spool
+	if ctx.config.AcctProxyMustSucceed && ctx.config.AcctProxySpool {
+		var err error
+		if spool, err = proxySpools.get(ctx.config); err != nil {
+			return err
+		}
+		if spool.Pending() {
+			return spool.Add(request)
+		}
+	}
+
+	_, err := radiusRouter.RouteRadiusRequest(request, ctx.config.ProxyGroupName, time.Duration(ctx.config.ProxyTimeoutMillis)*time.Millisecond, 1+ctx.config.ProxyRetries, 1+ctx.config.ProxyServerRetries, "")
+	if err != nil && spool != nil {
+		core.GetLogger().Warnf("error proxying to %s, spooling: %s", ctx.config.ProxyGroupName, err)
+		return spool.Add(request)
+	}
+
+	return err
 }
@@ -0,0 +1,367 @@
+package psbahandlers
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// The database accounting sink writes the session accounting to two tables in the clients database,
+// in addition to the CDR files, so that the usage may be checked by the customer care tools
+//
+//	create table accountingsessions (
+//		AcctSessionId varchar(64) not null,
+//		NAS varchar(64) not null,
+//		UserName varchar(128),
+//		AccessId varchar(64),
+//		AccessPort bigint,
+//		ExternalClientId varchar(64),
+//		FramedIPAddress varchar(64),
+//		StartTime datetime,
+//		LastUpdate datetime,
+//		StopTime datetime,
+//		SessionTime bigint,
+//		InputOctets bigint unsigned,
+//		OutputOctets bigint unsigned,
+//		TerminateCause varchar(64),
+//		primary key (AcctSessionId, NAS)
+//	);
+//
+//	create table dailyusage (
+//		AccessId varchar(64) not null,
+//		AccessPort bigint not null,
+//		Day date not null,
+//		ExternalClientId varchar(64),
+//		SessionTime bigint,
+//		InputOctets bigint unsigned,
+//		OutputOctets bigint unsigned,
+//		primary key (AccessId, AccessPort, Day)
+//	);
+//
+// The octets in the sessions table are the totals for the session, and those in the daily usage table are the
+// increments received during the day, calculated as the difference with the totals stored for the session. The
+// increments are also added to the usage of the client in the billing cycle, used to check the quotas
+
+// Values of a session accounting request to be written to the database
+type acctSinkRecord struct {
+	acctSessionId    string
+	nas              string
+	statusType       string
+	userName         string
+	accessId         string
+	accessPort       int64
+	externalClientId string
+	planName         string
+	framedIPAddress  string
+	terminateCause   string
+	eventTime        time.Time
+	sessionTime      int64
+	inputOctets      uint64
+	outputOctets     uint64
+
+	// If false, the counters are 32 bits and may have wrapped since the last report
+	hasGigawords bool
+}
+
+// Queues the session accounting requests and writes them in batches to the database, asynchronously,
+// so that the latency of the accounting does not depend on the database
+type AccountingSink struct {
+	records   chan acctSinkRecord
+	batchSize int
+	interval  time.Duration
+
+	// Writes a batch of records
+	write func([]acctSinkRecord) error
+
+	// Initial interval between attempts to write a batch. Doubled on each failure
+	retryInterval time.Duration
+
+	// Closed to stop the retries
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// The batches that fail are retried up to acctSinkMaxAttempts times, while the records keep being queued. After
+// acctSinkBatchAttempts failures, the records are written one by one to isolate those that can not be written
+const (
+	acctSinkMaxAttempts      = 10
+	acctSinkBatchAttempts    = 3
+	acctSinkMaxRetryInterval = 1 * time.Minute
+)
+
+// Initial interval between attempts to write a failed batch
+var acctSinkRetryInterval = 1 * time.Second
+
+var accountingSink *AccountingSink
+
+// Creates the sink and starts the writing of the batches. The batch is written when batchSize records are
+// accumulated, or after batchMillis. Up to queueSize records are queued; if the queue is full, the records
+// are discarded
+func NewAccountingSink(batchSize int, batchMillis int, queueSize int, write func([]acctSinkRecord) error) *AccountingSink {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if batchMillis <= 0 {
+		batchMillis = 1000
+	}
+	if queueSize <= 0 {
+		queueSize = 10000
+	}
+
+	s := AccountingSink{
+		records:       make(chan acctSinkRecord, queueSize),
+		batchSize:     batchSize,
+		interval:      time.Duration(batchMillis) * time.Millisecond,
+		write:         write,
+		retryInterval: acctSinkRetryInterval,
+		stopChan:      make(chan struct{}),
+		doneChan:      make(chan struct{}),
+	}
+	go s.loop()
+
+	return &s
+}
+
+// Queues the session accounting request. A nil receiver does nothing
+func (s *AccountingSink) Add(request *core.RadiusPacket, ctx *RequestContext) {
+	if s == nil {
+		return
+	}
+
+	statusType := request.GetStringAVP("Acct-Status-Type")
+	if statusType != "Start" && statusType != "Interim-Update" && statusType != "Stop" {
+		return
+	}
+	nas := request.GetStringAVP("NAS-IP-Address")
+	if nas == "" {
+		nas = request.GetStringAVP("NAS-Identifier")
+	}
+
+	record := acctSinkRecord{
+		acctSessionId:    request.GetStringAVP("Acct-Session-Id"),
+		nas:              nas,
+		statusType:       statusType,
+		userName:         ctx.userName,
+		accessId:         ctx.accessId,
+		accessPort:       ctx.accessPort,
+		externalClientId: request.GetStringAVP("PSA-ExternalClientId"),
+		planName:         request.GetStringAVP("PSA-PlanName"),
+		framedIPAddress:  request.GetStringAVP("Framed-IP-Address"),
+		terminateCause:   request.GetStringAVP("Acct-Terminate-Cause"),
+		eventTime:        time.Now().Add(-time.Duration(request.GetIntAVP("Acct-Delay-Time")) * time.Second),
+		sessionTime:      request.GetIntAVP("Acct-Session-Time"),
+		inputOctets:      octetsWithGigawords(request, "Acct-Input-Octets", "Acct-Input-Gigawords"),
+		outputOctets:     octetsWithGigawords(request, "Acct-Output-Octets", "Acct-Output-Gigawords"),
+		hasGigawords:     len(request.GetAllAVP("Acct-Input-Gigawords")) > 0 || len(request.GetAllAVP("Acct-Output-Gigawords")) > 0,
+	}
+	if eventTime := request.GetDateAVP("Event-Timestamp"); !eventTime.IsZero() {
+		record.eventTime = eventTime
+	}
+
+	select {
+	case s.records <- record:
+	default:
+		incrementCounter("accountingSink", "discarded")
+	}
+}
+
+// Writes the records still queued, without retries, and stops the sink
+func (s *AccountingSink) Close() {
+	close(s.stopChan)
+	close(s.records)
+	<-s.doneChan
+}
+
+func (s *AccountingSink) loop() {
+	defer close(s.doneChan)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	batch := make([]acctSinkRecord, 0, s.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.writeWithRetries(batch)
+		batch = make([]acctSinkRecord, 0, s.batchSize)
+	}
+
+	for {
+		select {
+		case record, ok := <-s.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Writes the batch, retrying with increasing intervals if it fails. The new records wait in the queue meanwhile,
+// so that the records of a session are written in order. The records not written after the maximum number of
+// attempts, or when the sink is being closed, are discarded
+func (s *AccountingSink) writeWithRetries(batch []acctSinkRecord) {
+	interval := s.retryInterval
+	for attempt := 1; ; attempt++ {
+		var err error
+		if attempt <= acctSinkBatchAttempts {
+			if err = s.write(batch); err == nil {
+				incrementCounter("accountingSink", "batch")
+				return
+			}
+		} else if batch, err = s.writeEach(batch); len(batch) == 0 {
+			return
+		}
+		core.GetLogger().Errorf("could not write %d accounting records to database in attempt %d: %s", len(batch), attempt, err)
+		incrementCounter("accountingSink", "error")
+
+		if attempt >= acctSinkMaxAttempts || !s.sleep(interval) {
+			core.GetLogger().Errorf("discarding %d accounting records", len(batch))
+			for range batch {
+				incrementCounter("accountingSink", "discarded")
+			}
+			return
+		}
+		if interval *= 2; interval > acctSinkMaxRetryInterval {
+			interval = acctSinkMaxRetryInterval
+		}
+	}
+}
+
+// Writes the records one by one, and returns those that could not be written. If some of them could, the
+// database is working and the others are considered bad, so they are discarded and nothing is returned
+func (s *AccountingSink) writeEach(records []acctSinkRecord) ([]acctSinkRecord, error) {
+	var failed []acctSinkRecord
+	var lastErr error
+	for _, r := range records {
+		if err := s.write([]acctSinkRecord{r}); err != nil {
+			failed = append(failed, r)
+			lastErr = err
+		}
+	}
+
+	if len(failed) == len(records) {
+		return failed, lastErr
+	}
+	for _, r := range failed {
+		core.GetLogger().Errorf("discarding accounting record of session %s, which could not be written", sessionKey(r.acctSessionId, r.nas))
+		incrementCounter("accountingSink", "discarded")
+	}
+	return nil, nil
+}
+
+// Waits for the specified time. Returns false if the sink is being closed
+func (s *AccountingSink) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stopChan:
+		return false
+	}
+}
+
+// Returns the increment of the counter since the previous total. If the counter is of 32 bits and is lower
+// than the previous value, it is assumed to have wrapped once. Counters with gigawords are not expected to
+// decrease, and in that case the increment is zero
+func counterDelta(previousTotal uint64, current uint64, hasGigawords bool) uint64 {
+	if hasGigawords {
+		if current < previousTotal {
+			return 0
+		}
+		return current - previousTotal
+	}
+
+	previous := previousTotal & 0xFFFFFFFF
+	if current < previous {
+		return current + 1<<32 - previous
+	}
+	return current - previous
+}
+
+// Writes the batch of records to the database, in a single transaction, and then queues the actions of the
+// quota thresholds crossed
+func writeAccountingToDatabase(records []acctSinkRecord) error {
+
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var crossings []quotaCrossing
+	for _, r := range records {
+		var prevSessionTime int64
+		var prevInput, prevOutput uint64
+		err := tx.QueryRow(`select SessionTime, InputOctets, OutputOctets from accountingsessions
+			where AcctSessionId = ? and NAS = ? for update`, r.acctSessionId, r.nas).Scan(&prevSessionTime, &prevInput, &prevOutput)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("could not read session %s: %w", sessionKey(r.acctSessionId, r.nas), err)
+		}
+
+		deltaInput := counterDelta(prevInput, r.inputOctets, r.hasGigawords)
+		deltaOutput := counterDelta(prevOutput, r.outputOctets, r.hasGigawords)
+		deltaSessionTime := r.sessionTime - prevSessionTime
+		if deltaSessionTime < 0 {
+			deltaSessionTime = 0
+		}
+
+		var stopTime interface{}
+		if r.statusType == "Stop" {
+			stopTime = r.eventTime
+		}
+
+		if _, err := tx.Exec(`insert into accountingsessions
+			(AcctSessionId, NAS, UserName, AccessId, AccessPort, ExternalClientId, FramedIPAddress, StartTime, LastUpdate, StopTime, SessionTime, InputOctets, OutputOctets, TerminateCause)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			on duplicate key update
+			UserName = values(UserName), ExternalClientId = values(ExternalClientId), FramedIPAddress = values(FramedIPAddress),
+			LastUpdate = values(LastUpdate), StopTime = values(StopTime), SessionTime = values(SessionTime),
+			InputOctets = values(InputOctets), OutputOctets = values(OutputOctets), TerminateCause = values(TerminateCause)`,
+			r.acctSessionId, r.nas, r.userName, r.accessId, r.accessPort, r.externalClientId, r.framedIPAddress,
+			r.eventTime.Add(-time.Duration(r.sessionTime)*time.Second), r.eventTime, stopTime, r.sessionTime,
+			prevInput+deltaInput, prevOutput+deltaOutput, r.terminateCause); err != nil {
+			return fmt.Errorf("could not write session %s: %w", sessionKey(r.acctSessionId, r.nas), err)
+		}
+
+		if deltaInput == 0 && deltaOutput == 0 && deltaSessionTime == 0 {
+			continue
+		}
+		if _, err := tx.Exec(`insert into dailyusage
+			(AccessId, AccessPort, Day, ExternalClientId, SessionTime, InputOctets, OutputOctets)
+			values (?, ?, ?, ?, ?, ?, ?)
+			on duplicate key update
+			ExternalClientId = values(ExternalClientId), SessionTime = SessionTime + values(SessionTime),
+			InputOctets = InputOctets + values(InputOctets), OutputOctets = OutputOctets + values(OutputOctets)`,
+			r.accessId, r.accessPort, r.eventTime.Format("2006-01-02"), r.externalClientId,
+			deltaSessionTime, deltaInput, deltaOutput); err != nil {
+			return fmt.Errorf("could not write daily usage of %s:%d: %w", r.accessId, r.accessPort, err)
+		}
+
+		if r.externalClientId != "" {
+			c, err := updateCycleUsage(tx, r, deltaSessionTime, deltaInput, deltaOutput)
+			if err != nil {
+				return err
+			}
+			crossings = append(crossings, c...)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	quotaEnforcer.Add(crossings)
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package psbahandlers
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestCounterDelta(t *testing.T) {
+	for _, c := range []struct {
+		previous     uint64
+		current      uint64
+		hasGigawords bool
+		delta        uint64
+	}{
+		{0, 100, false, 100},
+		{100, 250, false, 150},
+		// 32 bit counter wrapped
+		{0xFFFFFF00, 0x10, false, 0x110},
+		// The previous total includes a wrap
+		{1<<32 + 100, 200, false, 100},
+		{1<<32 + 100, 1<<32 + 300, true, 200},
+		// Gigawords counters do not decrease
+		{1<<32 + 100, 50, true, 0},
+	} {
+		if delta := counterDelta(c.previous, c.current, c.hasGigawords); delta != c.delta {
+			t.Errorf("delta of %d to %d (gigawords %t) is %d, expected %d", c.previous, c.current, c.hasGigawords, delta, c.delta)
+		}
+	}
+}
+
+func TestAccountingSink(t *testing.T) {
+
+	var mutex sync.Mutex
+	var batches [][]acctSinkRecord
+	write := func(records []acctSinkRecord) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		batches = append(batches, records)
+		return nil
+	}
+
+	sink := NewAccountingSink(2, 50, 10, write)
+	ctx := RequestContext{userName: "user@realm", accessId: "line1", accessPort: 1}
+
+	request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Acct-Session-Id", "session-1").
+		Add("Acct-Status-Type", "Interim-Update").
+		Add("Acct-Input-Octets", 10).
+		Add("Acct-Input-Gigawords", 1)
+
+	// Full batch
+	sink.Add(request, &ctx)
+	sink.Add(request, &ctx)
+	// Ignored
+	sink.Add(core.NewRadiusRequest(core.ACCOUNTING_REQUEST).Add("Acct-Status-Type", "Accounting-on"), &ctx)
+	// Written by the timer
+	sink.Add(request, &ctx)
+	time.Sleep(200 * time.Millisecond)
+
+	mutex.Lock()
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Errorf("bad batches %v", batches)
+	}
+	if r := batches[0][0]; r.inputOctets != 1<<32+10 || !r.hasGigawords || r.nas != "127.0.0.1" || r.accessId != "line1" {
+		t.Errorf("bad record %#v", r)
+	}
+	mutex.Unlock()
+
+	// Queued records are written when closing
+	sink.Add(request, &ctx)
+	sink.Close()
+	if len(batches) != 3 {
+		t.Errorf("queued records not written %v", batches)
+	}
+
+	// A nil sink does nothing
+	var disabled *AccountingSink
+	disabled.Add(request, &ctx)
+}
+
+func TestAccountingSinkRetries(t *testing.T) {
+
+	acctSinkRetryInterval = 10 * time.Millisecond
+	defer func() { acctSinkRetryInterval = 1 * time.Second }()
+
+	// The database is down for the first attempts, and the record of session "bad" can never be written
+	var mutex sync.Mutex
+	var failures int
+	var written []string
+	write := func(records []acctSinkRecord) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures < 2 {
+			failures++
+			return errors.New("database down")
+		}
+		for _, r := range records {
+			if r.acctSessionId == "bad" {
+				return errors.New("bad record")
+			}
+		}
+		for _, r := range records {
+			written = append(written, r.acctSessionId)
+		}
+		return nil
+	}
+
+	sink := NewAccountingSink(3, 50, 10, write)
+	ctx := RequestContext{userName: "user@realm"}
+	for _, id := range []string{"good-1", "bad", "good-2"} {
+		sink.Add(core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+			Add("NAS-IP-Address", "127.0.0.1").
+			Add("Acct-Session-Id", id).
+			Add("Acct-Status-Type", "Interim-Update"), &ctx)
+	}
+	time.Sleep(500 * time.Millisecond)
+	sink.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(written) != 2 || written[0] != "good-1" || written[1] != "good-2" {
+		t.Errorf("written records are %v", written)
+	}
+}
@@ -1,6 +1,7 @@
 package psbahandlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -27,7 +28,12 @@ func TestSessionAcctCDRWrite(t *testing.T) {
 		Packet:            requestPacket,
 	}
 
-	requestPacket1 := requestPacket.Copy(nil, nil)
+	class, complete := classCodec.Encode(ClassInfo{PlanName: "Plan1", ExternalClientId: "ExternalUser", SessionTimeoutReason: "planOverride"})
+	if !complete {
+		t.Fatalf("Class truncated to %s", class)
+	}
+	requestPacket1 := requestPacket.Copy(nil, nil).
+		Add("Class", class)
 
 	rrr.Packet = requestPacket1
 
@@ -53,6 +59,12 @@ func TestSessionAcctCDRWrite(t *testing.T) {
 	if !strings.Contains(string(fileBytes), "TestUsername") {
 		t.Fatalf("bad contents in cdr file")
 	}
+	if !strings.Contains(string(fileBytes), "planOverride") {
+		t.Fatalf("session timeout reason not found in cdr file")
+	}
+	if !strings.Contains(string(fileBytes), "ExternalUser") {
+		t.Fatalf("external client id not found in cdr file")
+	}
 
 	// The service CDR file is empty
 	serviceCDRFiles, err := os.ReadDir(serviceCDRDir)
@@ -64,6 +76,57 @@ func TestSessionAcctCDRWrite(t *testing.T) {
 	}
 }
 
+func TestForgedClass(t *testing.T) {
+
+	requestPacket := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 1).
+		Add("User-Name", "ForgedUsername").
+		Add("Class", "V:2#P:Plan1#C:ExternalForged#S:k2.0123456789abcdef")
+
+	if _, err := clientRouter.RouteRadiusRequest(requestPacket, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("could not send accounting request: %s", err)
+	}
+
+	// The CDR is flagged and the forged values are not written
+	sessionCDRFiles, err := os.ReadDir(sessionCDRDir)
+	if err != nil {
+		t.Fatalf("error reading session cdr directory: %s", err)
+	}
+	var found bool
+	for _, file := range sessionCDRFiles {
+		fileBytes, err := os.ReadFile(sessionCDRDir + "/" + file.Name())
+		if err != nil {
+			t.Fatalf("error reading session cdr file: %s", err)
+		}
+		for _, line := range strings.Split(string(fileBytes), "\n") {
+			if strings.Contains(line, "ForgedUsername") {
+				found = true
+				if !strings.Contains(line, "forged") || strings.Contains(line, "ExternalForged") {
+					t.Errorf("bad cdr for forged Class: %s", line)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Fatal("cdr for forged Class not found")
+	}
+
+	// And counted
+	resp, err := http2Client.Get("https://localhost:9191/counters?name=classStatus")
+	if err != nil {
+		t.Fatalf("could not get counters: %s", err)
+	}
+	defer resp.Body.Close()
+	var classStatus map[string]uint64
+	if err := json.NewDecoder(resp.Body).Decode(&classStatus); err != nil {
+		t.Fatalf("could not parse counters: %s", err)
+	}
+	if classStatus["forged"] == 0 {
+		t.Errorf("forged Class not counted: %v", classStatus)
+	}
+}
+
 func TestServiceAcctCDRWrite(t *testing.T) {
 
 	requestPacket := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
@@ -109,3 +172,288 @@ func TestServiceAcctCDRWrite(t *testing.T) {
 		t.Fatalf("bad contents in cdr file")
 	}
 }
+
+func TestWholesaleISP(t *testing.T) {
+
+	// The realm is not configured, but the client has an ISP
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9995).
+		Add("User-Name", "wholesale@spoofed.realm")
+
+	response, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, "")
+	if err != nil {
+		t.Fatalf("could not send access request: %s", err)
+	}
+	if vr := response.GetStringAVP("Unisphere-Virtual-Router"); vr != "vrouter-wholesale1" {
+		t.Errorf("bad isp virtual router %s", vr)
+	}
+	if isp := response.GetCiscoAVPair("isp"); isp != "wholesale1" {
+		t.Errorf("bad isp non overridable attribute %s", isp)
+	}
+	class := response.GetStringAVP("Class")
+	if !strings.Contains(class, "I:wholesale1") {
+		t.Fatalf("isp not found in Class %s", class)
+	}
+
+	// The accounting is written to the CDR writer of the ISP
+	acctRequest := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9995).
+		Add("User-Name", "wholesale@spoofed.realm").
+		Add("Acct-Status-Type", "Start").
+		Add("Class", class)
+	if _, err := clientRouter.RouteRadiusRequest(acctRequest, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("could not send accounting request: %s", err)
+	}
+
+	cdrFiles, err := os.ReadDir(wholesaleCDRDir)
+	if err != nil || len(cdrFiles) == 0 {
+		t.Fatalf("no isp cdr found: %s", err)
+	}
+	fileBytes, err := os.ReadFile(wholesaleCDRDir + "/" + cdrFiles[0].Name())
+	if err != nil {
+		t.Fatalf("error reading isp cdr file: %s", err)
+	}
+	if !strings.Contains(string(fileBytes), "ExternalWholesale") {
+		t.Errorf("bad contents in isp cdr file")
+	}
+}
+
+func TestActiveSessions(t *testing.T) {
+
+	sendAcct := func(statusType string, sessionTime int) {
+		request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+			Add("NAS-IP-Address", "127.0.0.1").
+			Add("NAS-Port", 9994).
+			Add("User-Name", "sessions@database").
+			Add("Acct-Session-Id", "active-session-1").
+			Add("Acct-Status-Type", statusType).
+			Add("Acct-Session-Time", sessionTime).
+			Add("Acct-Output-Octets", 1000).
+			Add("Acct-Output-Gigawords", 2).
+			Add("Framed-IP-Address", "10.99.0.1")
+		if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+			t.Fatalf("could not send accounting %s: %s", statusType, err)
+		}
+	}
+
+	sendAcct("Start", 0)
+	sendAcct("Interim-Update", 60)
+
+	page := getSessions(t, "accessLine=127.0.0.1:9994")
+	if page.Total != 1 || len(page.Sessions) != 1 {
+		t.Fatalf("session not found %v", page)
+	}
+	session := page.Sessions[0]
+	if session.AcctSessionId != "active-session-1" || session.SessionTime != 60 || session.OutputOctets != 2<<32+1000 {
+		t.Errorf("bad session %#v", session)
+	}
+	if page = getSessions(t, "ip=10.99.0.1"); page.Total != 1 {
+		t.Errorf("session not found by ip %v", page)
+	}
+
+	sendAcct("Stop", 120)
+	if page = getSessions(t, "accessLine=127.0.0.1:9994"); page.Total != 0 {
+		t.Errorf("session not removed %v", page)
+	}
+}
+
+// Retrieves the active sessions using the administrative API
+func getSessions(t *testing.T, query string) SessionsPage {
+	resp, err := http2Client.Get("https://localhost:9191/sessions?" + query)
+	if err != nil {
+		t.Fatalf("could not get sessions: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var page SessionsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("could not parse sessions: %s", err)
+	}
+	return page
+}
+
+func TestReapedSession(t *testing.T) {
+
+	request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9992).
+		Add("User-Name", "lostsession@database").
+		Add("Acct-Session-Id", "reaped-session-1").
+		Add("Acct-Status-Type", "Start").
+		Add("Acct-Interim-Interval", 60)
+	if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("could not send accounting start: %s", err)
+	}
+
+	// As if the interim updates had been lost. Only the session of this test is reaped, since the store is shared
+	stale, ok := sessionStore.Get("reaped-session-1", "127.0.0.1")
+	if !ok {
+		t.Fatal("session not created")
+	}
+	reapSession(stale)
+
+	if page := getSessions(t, "accessLine=127.0.0.1:9992"); page.Total != 0 {
+		t.Errorf("session not reaped %v", page)
+	}
+
+	// A synthetic stop is written
+	cdrFiles, err := os.ReadDir(sessionCDRDir)
+	if err != nil {
+		t.Fatalf("error reading session cdr directory: %s", err)
+	}
+	var found bool
+	for _, cdrFile := range cdrFiles {
+		fileBytes, _ := os.ReadFile(sessionCDRDir + "/" + cdrFile.Name())
+		for _, line := range strings.Split(string(fileBytes), "\n") {
+			if strings.Contains(line, "lostsession@database") && strings.Contains(line, "reaped") {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Error("synthetic stop not found")
+	}
+}
+
+func TestAccountingOn(t *testing.T) {
+
+	// A NAS with two sessions
+	for _, acctSessionId := range []string{"nas-session-1", "nas-session-2"} {
+		request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+			Add("NAS-IP-Address", "127.0.0.2").
+			Add("NAS-Port", 9991).
+			Add("User-Name", "rebooted@database").
+			Add("Acct-Session-Id", acctSessionId).
+			Add("Acct-Status-Type", "Start")
+		if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+			t.Fatalf("could not send accounting start: %s", err)
+		}
+	}
+	if page := getSessions(t, "nas=127.0.0.2"); page.Total != 2 {
+		t.Fatalf("sessions not created %v", page)
+	}
+
+	request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.2").
+		Add("Acct-Session-Id", "0").
+		Add("Acct-Status-Type", "Accounting-on")
+	if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("could not send accounting on: %s", err)
+	}
+
+	if page := getSessions(t, "nas=127.0.0.2"); page.Total != 0 {
+		t.Errorf("sessions not closed %v", page)
+	}
+
+	// The event is raised
+	resp, err := http2Client.Get("https://localhost:9191/events?name=nasRestart")
+	if err != nil {
+		t.Fatalf("could not get events: %s", err)
+	}
+	defer resp.Body.Close()
+	var events []HandlerEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatalf("could not parse events: %s", err)
+	}
+	if len(events) == 0 || events[len(events)-1].Source != "127.0.0.2" {
+		t.Errorf("nas restart event not found %v", events)
+	}
+}
+
+func TestDuplicateAccounting(t *testing.T) {
+
+	request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9990).
+		Add("User-Name", "retransmitted@database").
+		Add("Acct-Session-Id", "retransmitted-session-1").
+		Add("Acct-Status-Type", "Start")
+	for i := 0; i < 2; i++ {
+		if _, err := clientRouter.RouteRadiusRequest(request.Copy(nil, nil).Add("Acct-Delay-Time", i), "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+			t.Fatalf("retransmission %d not acknowledged: %s", i, err)
+		}
+	}
+
+	// Only one CDR is written
+	cdrFiles, err := os.ReadDir(sessionCDRDir)
+	if err != nil {
+		t.Fatalf("error reading session cdr directory: %s", err)
+	}
+	var cdrs int
+	for _, cdrFile := range cdrFiles {
+		fileBytes, _ := os.ReadFile(sessionCDRDir + "/" + cdrFile.Name())
+		cdrs += strings.Count(string(fileBytes), "retransmitted@database")
+	}
+	if cdrs != 1 {
+		t.Errorf("%d cdrs written", cdrs)
+	}
+
+	// And the duplicate is counted
+	resp, err := http2Client.Get("https://localhost:9191/counters?name=duplicateAccounting")
+	if err != nil {
+		t.Fatalf("could not get counters: %s", err)
+	}
+	defer resp.Body.Close()
+	var duplicates map[string]uint64
+	if err := json.NewDecoder(resp.Body).Decode(&duplicates); err != nil {
+		t.Fatalf("could not parse counters: %s", err)
+	}
+	if duplicates["Start"] == 0 {
+		t.Errorf("duplicate not counted: %v", duplicates)
+	}
+}
+
+func TestAcctProxyMustSucceed(t *testing.T) {
+
+	// Not answered if the proxy fails
+	request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9989).
+		Add("User-Name", "user@mustsucceed.proxy").
+		Add("Acct-Session-Id", "mustsucceed-session-1").
+		Add("Acct-Status-Type", "Start")
+	if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 2*time.Second, 1, 1, ""); err == nil {
+		t.Error("accounting answered although the proxy failed")
+	}
+
+	// Answered if spooled
+	request = core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9989).
+		Add("User-Name", "user@spool.mustsucceed.proxy").
+		Add("Acct-Session-Id", "mustsucceed-session-2").
+		Add("Acct-Status-Type", "Start")
+	if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 2*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("spooled accounting not answered: %s", err)
+	}
+
+	resp, err := http2Client.Get("https://localhost:9191/spools?target=proxy-psba-unreachable-group")
+	if err != nil {
+		t.Fatalf("could not get spool: %s", err)
+	}
+	defer resp.Body.Close()
+	var records []SpoolRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatalf("could not parse spool records: %s", err)
+	}
+	var found bool
+	for _, record := range records {
+		for _, avp := range record.AVPs {
+			if avp.Name == "User-Name" && avp.GetString() == "user@spool.mustsucceed.proxy" {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("request not spooled %v", records)
+	}
+
+	// Clean up
+	resp, err = http2Client.Post("https://localhost:9191/spools?target=proxy-psba-unreachable-group", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("could not purge spool: %s", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,161 @@
+package psbahandlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Configuration of the HTTP server that exposes the administrative API
+type AdminServerConfig struct {
+	// Defaults to 127.0.0.1
+	BindAddress string
+	BindPort    int
+
+	// Name of the environment variable holding the token that the clients must send as
+	// "Authorization: Bearer <token>". Defaults to PSBA_ADMIN_TOKEN. The token is not written in the
+	// configuration files. If the variable is not set, all the requests are rejected
+	TokenEnvironmentVariable string
+}
+
+var adminServer *http.Server
+var adminServerDoneChan chan struct{}
+
+// Starts the administrative HTTP server, in a separate goroutine
+func startAdminServer(ci *core.PolicyConfigurationManager) error {
+
+	adminConfig := core.NewConfigObject[AdminServerConfig]("adminServer.json")
+	if err := adminConfig.Update(&ci.CM); err != nil {
+		return fmt.Errorf("could not read adminServer.json: %w", err)
+	}
+	ac := adminConfig.Get()
+	if ac.BindAddress == "" {
+		ac.BindAddress = "127.0.0.1"
+	}
+	if ac.TokenEnvironmentVariable == "" {
+		ac.TokenEnvironmentVariable = "PSBA_ADMIN_TOKEN"
+	}
+	token := os.Getenv(ac.TokenEnvironmentVariable)
+	if token == "" {
+		core.GetLogger().Warnf("%s not set. All requests to the admin server will be rejected", ac.TokenEnvironmentVariable)
+	}
+
+	mux := new(http.ServeMux)
+	mux.HandleFunc("/profiles", profilesAdminHandler)
+	mux.HandleFunc("/ipam/pools", ipPoolsAdminHandler)
+	mux.HandleFunc("/ipam/leases", leasesAdminHandler)
+	mux.HandleFunc("/counters", countersAdminHandler)
+	mux.HandleFunc("/metrics", metricsAdminHandler)
+	mux.HandleFunc("/traces", tracesAdminHandler)
+	mux.HandleFunc("/evaluate", evaluationAdminHandler)
+	mux.HandleFunc("/lns", lnsAdminHandler)
+	mux.HandleFunc("/sessions", sessionsAdminHandler)
+	mux.HandleFunc("/coa", coaAdminHandler)
+	mux.HandleFunc("/events", eventsAdminHandler)
+	mux.HandleFunc("/spools", spoolsAdminHandler)
+	mux.HandleFunc("/usage", usageAdminHandler)
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", ac.BindAddress, ac.BindPort),
+		Handler:           requireToken(token, mux),
+		IdleTimeout:       1 * time.Minute,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	// Listen here, so that the error is reported to the caller
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen in %s: %w", server.Addr, err)
+	}
+
+	adminServer = server
+	adminServerDoneChan = make(chan struct{})
+
+	go func(server *http.Server, doneChan chan struct{}) {
+		defer close(doneChan)
+
+		// Make sure certificates exist
+		certFile, keyFile := core.GenerateCertificates()
+
+		core.GetLogger().Infof("admin server listening in %s", server.Addr)
+		if err := server.ServeTLS(listener, certFile, keyFile); !errors.Is(err, http.ErrServerClosed) {
+			core.GetLogger().Errorf("admin server terminated: %s", err)
+		}
+	}(adminServer, adminServerDoneChan)
+
+	return nil
+}
+
+// Rejects the requests that do not carry the bearer token. If the token is empty, all requests are rejected
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization := req.Header.Get("Authorization")
+		received := strings.TrimPrefix(authorization, "Bearer ")
+		if token == "" || received == authorization || subtle.ConstantTimeCompare([]byte(received), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Gracefully shuts down the administrative HTTP server
+func stopAdminServer() {
+	if adminServer != nil {
+		adminServer.Shutdown(context.Background())
+		<-adminServerDoneChan
+		adminServer = nil
+	}
+}
+
+// Writes the object as the JSON body of the response
+func writeJSONResponse(w http.ResponseWriter, v any) {
+	jBytes, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, "could not serialize response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jBytes)
+}
+
+// Dumps the profiles with the inheritance resolved. If the "name" query parameter is
+// specified, only that profile is returned
+func profilesAdminHandler(w http.ResponseWriter, req *http.Request) {
+
+	resolvedProfiles := profiles.Get()
+
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		writeJSONResponse(w, resolvedProfiles)
+		return
+	}
+
+	if profile, found := resolvedProfiles[name]; found {
+		writeJSONResponse(w, profile)
+	} else {
+		http.Error(w, "profile not found: "+name, http.StatusNotFound)
+	}
+}
+
+// Returns the size and usage of the local address pools
+func ipPoolsAdminHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSONResponse(w, ipam.PoolsStatus())
+}
+
+// Returns the leases of local addresses, optionally filtered by the "pool", "accessLine"
+// and "address" query parameters
+func leasesAdminHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	writeJSONResponse(w, ipam.Leases(query.Get("pool"), query.Get("accessLine"), query.Get("address")))
+}
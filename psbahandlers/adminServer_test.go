@@ -0,0 +1,55 @@
+package psbahandlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminToken(t *testing.T) {
+
+	okHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	for _, c := range []struct {
+		token         string
+		authorization string
+		status        int
+	}{
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "Bearer other", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		// Without token, everything is rejected
+		{"", "Bearer ", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/counters", nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		rec := httptest.NewRecorder()
+		requireToken(c.token, okHandler).ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("status %d for token %q and authorization %q", rec.Code, c.token, c.authorization)
+		}
+	}
+}
+
+func TestMetricsExport(t *testing.T) {
+
+	incrementCounter("duplicateAccounting", "Interim-Update")
+	incrementCounter("duplicateAccounting", `bad"label`)
+
+	rec := httptest.NewRecorder()
+	metricsAdminHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"# TYPE psba_duplicate_accounting counter\n",
+		"psba_duplicate_accounting{label=\"Interim-Update\"} ",
+		`psba_duplicate_accounting{label="bad\"label"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("%s not found in metrics %s", expected, body)
+		}
+	}
+}
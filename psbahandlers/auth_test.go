@@ -1,7 +1,9 @@
 package psbahandlers
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -523,6 +525,194 @@ func TestAuthLocalFileWithOverrideSpeedy(t *testing.T) {
 	testInvoker.testCaseRaw(t, "01 betatester with correct password", checks, &rrr)
 }
 
+func TestBlockingStatuses(t *testing.T) {
+
+	domain := "file.provision.permissive.noreject.block_basic.noproxy"
+
+	requestPacket := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9999).
+		Add("Igor-OctetsAttribute", "01")
+
+	rrr := router.RoutableRadiusRequest{
+		Destination:       "psba-server-group",
+		PerRequestTimeout: 1 * time.Second,
+		Tries:             1,
+		ServerTries:       1,
+		Packet:            requestPacket,
+	}
+
+	// Provision: file
+	// Authlocal: provision
+
+	// Non-payment. Captive portal with Session-Timeout
+	requestPacket1 := requestPacket.Copy(nil, nil).
+		Add("User-Name", "nonpayment@"+domain)
+
+	rrr.Packet = requestPacket1
+
+	checks := []TestCheck{
+		{"code is", "", "2"},
+		{"avp is", "Unisphere-Service-Bundle", "Apcautiv"},                  // Blocking basic profile
+		{"avp notpresent", "HW-Output-Committed-Information-Rate", ""},      // Basic profile replaced
+		{"avp is", "Session-Timeout", "1800"},                               // Blocking session timeout
+		{"avp is", "Reply-Message", "service suspended due to non-payment"}, // Blocking reply message
+	}
+
+	testInvoker.testCaseRaw(t, "01 non-payment blocking status", checks, &rrr)
+
+	// Fraud. Rejected, so the reject profile is assigned
+	requestPacket2 := requestPacket.Copy(nil, nil).
+		Add("User-Name", "fraud@"+domain)
+
+	rrr.Packet = requestPacket2
+
+	checks = []TestCheck{
+		{"code is", "", "2"},
+		{"avp is", "Unisphere-Service-Bundle", "Apreject"}, // Reject profile
+		{"avp notpresent", "Session-Timeout", ""},          // Blocking treatment not applied
+	}
+
+	testInvoker.testCaseRaw(t, "02 fraud blocking status", checks, &rrr)
+}
+
+func TestClientParameters(t *testing.T) {
+
+	requestPacket := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9999).
+		Add("User-Name", "custom@file.provision.permissive.noreject.block_basic.noproxy").
+		Add("Igor-OctetsAttribute", "01")
+
+	rrr := router.RoutableRadiusRequest{
+		Destination:       "psba-server-group",
+		PerRequestTimeout: 1 * time.Second,
+		Tries:             1,
+		ServerTries:       1,
+		Packet:            requestPacket,
+	}
+
+	checks := []TestCheck{
+		{"code is", "", "2"},
+		{"avp is", "HW-Output-Committed-Information-Rate", "5000"},      // Speed from client parameters
+		{"avp is", "Unisphere-Virtual-Router", "customvrf"},             // Templated reply item
+		{"avp contains", "Class", "V:2#P:Plan1#C:ExternalCustom#S:k2."}, // Signed with the first key
+	}
+
+	testInvoker.testCaseRaw(t, "01 client parameters", checks, &rrr)
+}
+
+func TestUpstreamAttributesNotRendered(t *testing.T) {
+
+	domain := "database.provision.nopermissive.doreject.block_addon.proxy"
+
+	// The upstream server echoes the attributes of the request
+	requestPacket := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 1).
+		Add("User-Name", "francisco@"+domain).
+		Add("Filter-Id", "{{.Speed}}-${client.ExternalClientId}")
+
+	rrr := router.RoutableRadiusRequest{
+		Destination:       "psba-server-group",
+		PerRequestTimeout: 1 * time.Second,
+		Tries:             1,
+		ServerTries:       1,
+		Packet:            requestPacket,
+	}
+
+	checks := []TestCheck{
+		{"code is", "", "2"},
+		{"avp is", "Filter-Id", "{{.Speed}}-${client.ExternalClientId}"},
+	}
+
+	testInvoker.testCaseRaw(t, "01 upstream attributes not rendered", checks, &rrr)
+}
+
+func TestRequestVariables(t *testing.T) {
+
+	domain := "file.provision.permissive.noreject.block_basic.noproxy"
+
+	requestPacket := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9999).
+		Add("User-Name", "variables@"+domain).
+		Add("Igor-OctetsAttribute", "01")
+
+	rrr := router.RoutableRadiusRequest{
+		Destination:       "psba-server-group",
+		PerRequestTimeout: 1 * time.Second,
+		Tries:             1,
+		ServerTries:       1,
+		Packet:            requestPacket,
+	}
+
+	checks := []TestCheck{
+		{"code is", "", "2"},
+		{"avp is", "Filter-Id", "ExternalVariables-Plan1-" + domain}, // Client, plan and realm variables
+		{"avp is", "HW-Service-Info", "127.0.0.1:nocli"},             // Request attribute and default value
+		{"cisco avpair is", "subscriber:nas-port", "9999"},           // Request attribute
+		{"cisco avpair notpresent", "subscriber:missing", ""},        // Missing variable without default
+	}
+
+	testInvoker.testCaseRaw(t, "01 request variables", checks, &rrr)
+}
+
+func TestDualStack(t *testing.T) {
+
+	domain := "file.provision.permissive.noreject.block_basic.noproxy"
+
+	requestPacket := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9999).
+		Add("Igor-OctetsAttribute", "01")
+
+	rrr := router.RoutableRadiusRequest{
+		Destination:       "psba-server-group",
+		PerRequestTimeout: 1 * time.Second,
+		Tries:             1,
+		ServerTries:       1,
+	}
+
+	// Dual stack
+	rrr.Packet = requestPacket.Copy(nil, nil).Add("User-Name", "dualstack@"+domain)
+
+	checks := []TestCheck{
+		{"code is", "", "2"},
+		{"avp is", "Framed-IP-Address", "192.168.100.1"},
+		{"avp is", "Delegated-IPv6-Prefix", "2001:db8:100:100::/56"},
+		{"avp is", "Framed-IPv6-Prefix", "2001:db8:200:200::/64"}, // From WAN prefix
+		{"avp is", "Framed-Interface-Id", "0000000000000001"},     // From WAN prefix
+	}
+
+	testInvoker.testCaseRaw(t, "01 dual stack", checks, &rrr)
+
+	// IPv4 only
+	rrr.Packet = requestPacket.Copy(nil, nil).Add("User-Name", "ipv4only@"+domain)
+
+	checks = []TestCheck{
+		{"code is", "", "2"},
+		{"avp is", "Framed-IP-Address", "192.168.100.1"},
+		{"avp notpresent", "Delegated-IPv6-Prefix", ""},
+		{"avp notpresent", "Framed-IPv6-Prefix", ""},
+		{"avp notpresent", "Framed-Interface-Id", ""},
+	}
+
+	testInvoker.testCaseRaw(t, "02 ipv4 only", checks, &rrr)
+
+	// IPv6 only
+	rrr.Packet = requestPacket.Copy(nil, nil).Add("User-Name", "ipv6only@"+domain)
+
+	checks = []TestCheck{
+		{"code is", "", "2"},
+		{"avp notpresent", "Framed-IP-Address", ""},
+		{"avp is", "Delegated-IPv6-Prefix", "2001:db8:100:100::/56"},
+		{"avp is", "Framed-IPv6-Prefix", "2001:db8:200:200::/64"},
+	}
+
+	testInvoker.testCaseRaw(t, "03 ipv6 only", checks, &rrr)
+}
+
 func TestNotification(t *testing.T) {
 
 	domain := "database.provision.nopermissive.doreject.block_addon.proxy"
@@ -565,6 +755,8 @@ func TestNotification(t *testing.T) {
 		{"cisco avpair is", "realm", domain},                              // AVPair from realm configuration
 		{"avp is", "Framed-IP-Address", "10.10.10.10"},                    // Attribute sent by proxy
 		{"avp is", "Unisphere-Service-Bundle", "Apubli"},                  // Notification addon
+		{"avp present", "Session-Timeout", ""},                            // Re-authenticate after notification expiration
+		{"avp contains", "Class", "T:notification"},                       // Reason of the Session-Timeout
 	}
 
 	testInvoker.testCaseRaw(t, "01 notification addon", checks, &rrr)
@@ -689,3 +881,130 @@ func TestAddonOverride(t *testing.T) {
 
 	testInvoker.testCaseRaw(t, "01 Addon override", checks, &rrr)
 }
+
+func TestVendorSpecificAttributes(t *testing.T) {
+
+	domain := "database.provision.nopermissive.doreject.block_addon.noproxy"
+
+	var passwordBytes = fmt.Sprintf("%x", []byte("francisco"))
+
+	requestPacket := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Igor-OctetsAttribute", "01")
+
+	rrr := router.RoutableRadiusRequest{
+		Destination:       "psba-server-group",
+		PerRequestTimeout: 1 * time.Second,
+		Tries:             1,
+		ServerTries:       1,
+		Packet:            requestPacket,
+	}
+
+	// Provision: database
+	// Authlocal: provision
+
+	// Cisco client
+	requestPacket1 := requestPacket.Copy(nil, nil).
+		Add("NAS-Port", 1).
+		Add("User-Name", "francisco@"+domain).
+		Add("User-Password", passwordBytes).
+		Add("Cisco-AVPair", "client-mac-address=0000.0000.0001")
+
+	rrr.Packet = requestPacket1
+
+	checks := []TestCheck{
+		{"code is", "", "2"},
+		{"cisco avpair is", "subscriber:sa", "internet(shape-rate=1000)"}, // Rate limit rendered for Cisco
+		{"cisco avpair is", "global", "true"},                             // Cisco AVPair global --> Nonoverridable attributes in global config
+		{"avp notpresent", "HW-Output-Committed-Information-Rate", ""},    // Rate limit not rendered for Huawei
+		{"avp notpresent", "Unisphere-Virtual-Router", ""},                // Virtual Router from realm configuration is removed
+		{"avp is", "Redback-Client-DNS-Primary", "8.8.8.8"},               // Not specific of any client type
+	}
+
+	testInvoker.testCaseRaw(t, "01 Cisco client", checks, &rrr)
+}
+
+func TestDecisionTrace(t *testing.T) {
+
+	userName := "nonpayment@file.provision.permissive.noreject.block_basic.noproxy"
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9998).
+		Add("User-Name", userName)
+
+	if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("could not send access request: %s", err)
+	}
+
+	for _, query := range []string{"userName=" + userName, "accessLine=127.0.0.1:9998"} {
+		resp, err := http2Client.Get("https://localhost:9191/traces?" + query)
+		if err != nil {
+			t.Fatalf("could not get traces: %s", err)
+		}
+		var traces []DecisionTrace
+		err = json.NewDecoder(resp.Body).Decode(&traces)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("could not parse traces: %s", err)
+		}
+		if len(traces) == 0 {
+			t.Fatalf("no traces found for %s", query)
+		}
+
+		// The most recent is the first one
+		trace := traces[0]
+		if trace.LookupKey != "file userName="+userName || !trace.ClientFound || trace.ExternalClientId != "ExternalNonPayment" {
+			t.Errorf("bad client lookup in trace %v", trace)
+		}
+		if len(trace.Overrides) == 0 || !strings.Contains(trace.Overrides[0], "non-payment") {
+			t.Errorf("blocking override not found in trace %v", trace.Overrides)
+		}
+		if trace.BasicProfile != "pcautiv" || trace.Result != "accept" || len(trace.Attributes) == 0 {
+			t.Errorf("bad result in trace %v", trace)
+		}
+	}
+}
+
+func TestWholesaleTunnels(t *testing.T) {
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9995).
+		Add("User-Name", "wholesale@spoofed.realm")
+
+	// Returns the endpoints of the tunnels, indexed by tag
+	getEndpoints := func() map[byte]string {
+		response, err := clientRouter.RouteRadiusRequest(request.Copy(nil, nil), "psba-server-group", 1*time.Second, 1, 1, "")
+		if err != nil {
+			t.Fatalf("could not send access request: %s", err)
+		}
+		endpoints := make(map[byte]string)
+		for _, avp := range response.GetAllAVP("Tunnel-Server-Endpoint") {
+			endpoints[avp.GetTag()] = avp.GetString()
+		}
+		return endpoints
+	}
+
+	// Two tunnels, as configured in maxTunnels
+	if endpoints := getEndpoints(); len(endpoints) != 2 || endpoints[1] == "" || endpoints[2] == "" {
+		t.Errorf("bad tunnel endpoints %v", endpoints)
+	}
+
+	// Drain all but one
+	drain := func(server string, drained bool) {
+		resp, err := http2Client.Post(fmt.Sprintf("https://localhost:9191/lns?set=wholesale1-lns&server=%s&drained=%t", server, drained), "text/plain", nil)
+		if err != nil {
+			t.Fatalf("could not drain lns: %s", err)
+		}
+		resp.Body.Close()
+	}
+	drain("lns1", true)
+	drain("lns2", true)
+	defer drain("lns1", false)
+	defer drain("lns2", false)
+
+	if endpoints := getEndpoints(); len(endpoints) != 1 || endpoints[1] != "10.200.0.3" {
+		t.Errorf("drained lns used %v", endpoints)
+	}
+}
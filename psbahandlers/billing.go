@@ -0,0 +1,155 @@
+package psbahandlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/francistor/igor/handler"
+)
+
+// Time zone in which the billing cycles start. Set from the BillingTimeZone configuration
+var billingLocation = time.Local
+
+// Implemented by *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Returns the start of the billing cycle that includes the specified time, and the start of the next one. The
+// cycles start at midnight, in the billing time zone, of the specified day of the month, or of the last day of
+// the month if it is shorter. Days out of the 1 to 31 range are taken as 1
+func billingCycle(t time.Time, day int) (time.Time, time.Time) {
+	if day < 1 || day > 31 {
+		day = 1
+	}
+	t = t.In(billingLocation)
+
+	start := cycleStartInMonth(t.Year(), t.Month(), day)
+	if t.Before(start) {
+		start = cycleStartInMonth(t.Year(), t.Month()-1, day)
+	}
+	return start, cycleStartInMonth(start.Year(), start.Month()+1, day)
+}
+
+// Returns the start of the billing cycle in the specified month, which is normalized as in time.Date
+func cycleStartInMonth(year int, month time.Month, day int) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, billingLocation)
+	if lastDay := first.AddDate(0, 1, -1).Day(); day > lastDay {
+		day = lastDay
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, billingLocation)
+}
+
+// Returns the day of the month in which the billing cycle of the client starts, and the plan name, as specified
+// in the clients table, or in the special users file for the clients not in the database. The day is zero if not
+// specified. The special user is looked for by user name, if known, and otherwise by external client id
+func clientBillingInfo(q rowQuerier, externalClientId string, userName string) (int, string, error) {
+	var day sql.NullInt32
+	var planName string
+	err := q.QueryRow("select BillingCycle, PlanName from clients where ExternalClientId = ?", externalClientId).Scan(&day, &planName)
+	if err == nil {
+		return int(day.Int32), planName, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	if userEntry, found := findSpecialUser(specialUsers.Get(), userName, externalClientId); found {
+		planName = userEntry.CheckItems["planName"]
+		if bc := userEntry.CheckItems["billingCycle"]; bc != "" {
+			d, err := strconv.Atoi(bc)
+			return d, planName, err
+		}
+		return 0, planName, nil
+	}
+	return 0, "", nil
+}
+
+// Returns the entry in the special users file with the specified user name or, if not found, the one with the
+// specified external client id
+func findSpecialUser(users handler.RadiusUserFile, userName string, externalClientId string) (handler.RadiusUserFileEntry, bool) {
+	if userEntry, found := users[userName]; found {
+		return userEntry, true
+	}
+	if externalClientId == "" {
+		return handler.RadiusUserFileEntry{}, false
+	}
+	for _, userEntry := range users {
+		if userEntry.CheckItems["externalClientId"] == externalClientId {
+			return userEntry, true
+		}
+	}
+	return handler.RadiusUserFileEntry{}, false
+}
+
+// Usage of a client in a billing cycle
+type CycleUsage struct {
+	Start        time.Time
+	End          time.Time
+	SessionTime  int64
+	InputOctets  uint64
+	OutputOctets uint64
+
+	// Only for clients whose plan has a quota
+	QuotaPercent *int `json:",omitempty"`
+}
+
+// Returns the usage of the client in the billing cycle. Cycles without accounting have zero usage
+func readCycleUsage(externalClientId string, start time.Time, end time.Time) (CycleUsage, error) {
+	usage := CycleUsage{Start: start, End: end}
+	err := dbHandle.QueryRow("select SessionTime, InputOctets, OutputOctets from cycleusage where ExternalClientId = ? and CycleStart = ?",
+		externalClientId, start).Scan(&usage.SessionTime, &usage.InputOctets, &usage.OutputOctets)
+	if err == sql.ErrNoRows {
+		return usage, nil
+	}
+	return usage, err
+}
+
+// Usage report of a client
+type ClientUsage struct {
+	ExternalClientId string
+	BillingCycle     int
+	Current          CycleUsage
+	Previous         CycleUsage
+}
+
+// Returns the usage of the client, specified with the "clientId" parameter holding the ExternalClientId, in the
+// current and previous billing cycles. If the plan of the client has a quota, the percentage used is also reported
+func usageAdminHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	externalClientId := query.Get("clientId")
+	if externalClientId == "" {
+		http.Error(w, "missing clientId", http.StatusBadRequest)
+		return
+	}
+
+	day, planName, err := clientBillingInfo(dbHandle, externalClientId, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := ClientUsage{ExternalClientId: externalClientId, BillingCycle: day}
+	currentStart, currentEnd := billingCycle(time.Now(), day)
+	previousStart, _ := billingCycle(currentStart.Add(-time.Second), day)
+	if report.Current, err = readCycleUsage(externalClientId, currentStart, currentEnd); err != nil {
+		http.Error(w, fmt.Sprintf("could not read usage: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if report.Previous, err = readCycleUsage(externalClientId, previousStart, currentStart); err != nil {
+		http.Error(w, fmt.Sprintf("could not read usage: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if quota := basicProfiles.GetQuota(planName); quota != nil {
+		for _, usage := range []*CycleUsage{&report.Current, &report.Previous} {
+			percent := quota.percent(usage.InputOctets + usage.OutputOctets)
+			usage.QuotaPercent = &percent
+		}
+	}
+
+	writeJSONResponse(w, report)
+}
@@ -0,0 +1,71 @@
+package psbahandlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/handler"
+)
+
+func TestBillingCycle(t *testing.T) {
+
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	previousLocation := billingLocation
+	billingLocation = madrid
+	defer func() { billingLocation = previousLocation }()
+
+	date := func(year int, month time.Month, day int, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, madrid)
+	}
+
+	for _, c := range []struct {
+		t     time.Time
+		day   int
+		start time.Time
+		end   time.Time
+	}{
+		// Default is the first of the month
+		{date(2023, 2, 15, 10), 0, date(2023, 2, 1, 0), date(2023, 3, 1, 0)},
+		{date(2023, 2, 15, 10), 10, date(2023, 2, 10, 0), date(2023, 3, 10, 0)},
+		// Before the day in the month
+		{date(2023, 2, 5, 10), 10, date(2023, 1, 10, 0), date(2023, 2, 10, 0)},
+		// Short months
+		{date(2023, 2, 28, 10), 31, date(2023, 2, 28, 0), date(2023, 3, 31, 0)},
+		{date(2023, 3, 15, 10), 31, date(2023, 2, 28, 0), date(2023, 3, 31, 0)},
+		{date(2024, 2, 29, 10), 30, date(2024, 2, 29, 0), date(2024, 3, 30, 0)},
+		{date(2023, 4, 30, 10), 31, date(2023, 4, 30, 0), date(2023, 5, 31, 0)},
+		// Change of year
+		{date(2023, 1, 3, 10), 15, date(2022, 12, 15, 0), date(2023, 1, 15, 0)},
+		// The time is converted to the billing time zone. 23:30 UTC of the last day is already the next cycle
+		{time.Date(2023, 6, 30, 23, 30, 0, 0, time.UTC), 1, date(2023, 7, 1, 0), date(2023, 8, 1, 0)},
+	} {
+		start, end := billingCycle(c.t, c.day)
+		if !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Errorf("cycle for %s with day %d is %s - %s, expected %s - %s", c.t, c.day, start, end, c.start, c.end)
+		}
+	}
+}
+
+func TestFindSpecialUser(t *testing.T) {
+
+	users := handler.RadiusUserFile{
+		"user1@file": {CheckItems: handler.Properties{"externalClientId": "ExternalUser1", "billingCycle": "15"}},
+		"user2@file": {CheckItems: handler.Properties{"externalClientId": "ExternalUser2"}},
+	}
+
+	// The accounting knows the user name, and the usage report only the external client id
+	for _, c := range []struct{ userName, externalClientId string }{{"user1@file", "ExternalUser1"}, {"", "ExternalUser1"}} {
+		if entry, found := findSpecialUser(users, c.userName, c.externalClientId); !found || entry.CheckItems["billingCycle"] != "15" {
+			t.Errorf("special user not found by %q %q", c.userName, c.externalClientId)
+		}
+	}
+	if _, found := findSpecialUser(users, "", ""); found {
+		t.Error("special user found without user name or external client id")
+	}
+	if _, found := findSpecialUser(users, "other@file", "ExternalOther"); found {
+		t.Error("unknown special user found")
+	}
+}
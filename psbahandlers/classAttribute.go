@@ -0,0 +1,341 @@
+package psbahandlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/francistor/igor/core"
+)
+
+// Version of the format of the Class attribute generated. Versions 0 (without version item) and 1 used a
+// fixed format, without escaping or signature
+const classVersion = "2"
+
+// Values of the PSA-ClassStatus attribute added to the accounting requests
+const (
+	classStatusValid    = "valid"
+	classStatusUnsigned = "unsigned"
+	classStatusForged   = "forged"
+	classStatusMangled  = "mangled"
+)
+
+// Information sent in the Class attribute of the Access-Accept, and received back in
+// the accounting requests
+type ClassInfo struct {
+	PlanName             string
+	ExternalClientId     string
+	ISP                  string
+	AddonProfile         string
+	SessionTimeoutReason string
+}
+
+// Accessors for the fields of the ClassInfo that may be used in the format
+var classFields = map[string]func(ci *ClassInfo) *string{
+	"plan":                 func(ci *ClassInfo) *string { return &ci.PlanName },
+	"externalClientId":     func(ci *ClassInfo) *string { return &ci.ExternalClientId },
+	"isp":                  func(ci *ClassInfo) *string { return &ci.ISP },
+	"addon":                func(ci *ClassInfo) *string { return &ci.AddonProfile },
+	"sessionTimeoutReason": func(ci *ClassInfo) *string { return &ci.SessionTimeoutReason },
+}
+
+// Key used to sign the Class attribute
+type ClassSigningKey struct {
+	// Sent in the signature, to find the key to use for verification
+	Id string
+
+	// Name of the environment variable holding the secret, so that it is not kept in the configuration files
+	SecretEnvironmentVariable string
+
+	// Used if the environment variable is not specified. For testing only
+	Secret string
+}
+
+// Configuration of the encoding of the Class attribute
+type ClassCodecConfig struct {
+	// Separator of the items. Defaults to "#"
+	Separator string
+
+	// Items to include, in order, as <tag>:<field>, where field is plan, externalClientId, isp, addon or
+	// sessionTimeoutReason. Items with empty values are not sent
+	Format []string
+
+	// The first key is used to sign. All of them are accepted when verifying, so that keys may be rotated
+	// by adding a new one in the first position and removing the last one after the sessions are renewed.
+	// If empty, the Class is not signed
+	SigningKeys []ClassSigningKey
+
+	// Number of hex characters of the signature. Defaults to 16
+	SignatureLength int
+
+	// Whether Class attributes without signature are considered forged. Always the case if signing keys are
+	// configured, since otherwise a signed Class could be accepted after removing the signature
+	RequireSignature bool
+}
+
+type classItem struct {
+	tag   string
+	field string
+}
+
+// Encodes and decodes the Class attribute
+type ClassCodec struct {
+	config ClassCodecConfig
+	items  []classItem
+}
+
+// Creates the codec, verifying the configuration
+func NewClassCodec(config ClassCodecConfig) (*ClassCodec, error) {
+
+	if config.Separator == "" {
+		config.Separator = "#"
+	}
+	if len(config.Separator) != 1 || strings.ContainsAny(config.Separator, "%:.") {
+		return nil, fmt.Errorf("bad separator %s", config.Separator)
+	}
+	if config.SignatureLength == 0 {
+		config.SignatureLength = 16
+	}
+	if config.SignatureLength > 2*sha256.Size {
+		return nil, fmt.Errorf("signature length %d too big", config.SignatureLength)
+	}
+
+	cc := ClassCodec{config: config}
+	tags := map[string]bool{"V": true, "S": true}
+	for _, formatItem := range config.Format {
+		tag, field, found := strings.Cut(formatItem, ":")
+		if !found || tag == "" || strings.Contains(tag, config.Separator) {
+			return nil, fmt.Errorf("bad format item %s", formatItem)
+		}
+		if _, found := classFields[field]; !found {
+			return nil, fmt.Errorf("unknown field %s", field)
+		}
+		if tags[tag] {
+			return nil, fmt.Errorf("duplicate or reserved tag %s", tag)
+		}
+		tags[tag] = true
+		cc.items = append(cc.items, classItem{tag: tag, field: field})
+	}
+
+	signingKeys := make([]ClassSigningKey, 0, len(config.SigningKeys))
+	for _, key := range config.SigningKeys {
+		if key.Id == "" || len(key.Id) > maxSigningKeyIdLength || strings.ContainsAny(key.Id, config.Separator+".") {
+			return nil, fmt.Errorf("bad signing key id %s", key.Id)
+		}
+		if key.SecretEnvironmentVariable != "" {
+			key.Secret = os.Getenv(key.SecretEnvironmentVariable)
+		}
+		if key.Secret == "" {
+			return nil, fmt.Errorf("no secret for signing key %s", key.Id)
+		}
+		signingKeys = append(signingKeys, key)
+	}
+	cc.config.SigningKeys = signingKeys
+
+	return &cc, nil
+}
+
+// Maximum length of the value of a radius attribute
+const maxClassLength = 253
+
+// Maximum length of the id of a signing key, so that a Class with only the version and the signature
+// always fits in the attribute
+const maxSigningKeyIdLength = 32
+
+// Fields removed from the Class, in this order, if it does not fit in the attribute. The signature is always kept
+var classDropOrder = []string{"sessionTimeoutReason", "isp", "addon", "externalClientId", "plan"}
+
+// Generates the value of the Class attribute, signed if keys are configured. If it does not fit in the
+// attribute, fields are removed as specified in classDropOrder until it does, and false is returned
+func (cc *ClassCodec) Encode(ci ClassInfo) (string, bool) {
+
+	complete := true
+	for _, field := range classDropOrder {
+		class := cc.encode(ci)
+		if len(class) <= maxClassLength {
+			return class, complete
+		}
+		if value := classFields[field](&ci); *value != "" {
+			*value = ""
+			complete = false
+		}
+	}
+
+	return cc.encode(ci), false
+}
+
+// Generates the value of the Class attribute, without checking the length
+func (cc *ClassCodec) encode(ci ClassInfo) string {
+
+	sep := cc.config.Separator
+
+	items := []string{"V:" + classVersion}
+	for _, item := range cc.items {
+		if value := *classFields[item.field](&ci); value != "" {
+			items = append(items, item.tag+":"+escapeClassValue(value, sep))
+		}
+	}
+	class := strings.Join(items, sep)
+
+	if len(cc.config.SigningKeys) > 0 {
+		key := cc.config.SigningKeys[0]
+		class += sep + "S:" + key.Id + "." + cc.signature(class, key.Secret)
+	}
+
+	return class
+}
+
+// Parses the value of the Class attribute, returning also the status of the signature verification.
+// If the status is not valid or unsigned, the ClassInfo must not be used
+func (cc *ClassCodec) Decode(class string) (ClassInfo, string) {
+
+	sep := cc.config.Separator
+
+	if !strings.HasPrefix(class, "V:"+classVersion+sep) {
+		// Previous versions
+		if ci, err := decodeLegacyClass(class); err == nil {
+			return ci, cc.unsignedStatus()
+		}
+		return ClassInfo{}, classStatusMangled
+	}
+
+	// Verify the signature
+	status := cc.unsignedStatus()
+	if pos := strings.LastIndex(class, sep+"S:"); pos != -1 {
+		keyId, signature, _ := strings.Cut(class[pos+len(sep)+2:], ".")
+		class = class[:pos]
+		status = classStatusForged
+		for _, key := range cc.config.SigningKeys {
+			if key.Id == keyId && hmac.Equal([]byte(signature), []byte(cc.signature(class, key.Secret))) {
+				status = classStatusValid
+				break
+			}
+		}
+	}
+
+	// Decode the items
+	var ci ClassInfo
+	for _, classItem := range strings.Split(class, sep)[1:] {
+		tag, value, found := strings.Cut(classItem, ":")
+		if !found {
+			return ClassInfo{}, classStatusMangled
+		}
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			return ClassInfo{}, classStatusMangled
+		}
+		for _, item := range cc.items {
+			if item.tag == tag {
+				*classFields[item.field](&ci) = unescaped
+			}
+		}
+	}
+
+	return ci, status
+}
+
+func (cc *ClassCodec) unsignedStatus() string {
+	if cc.config.RequireSignature || len(cc.config.SigningKeys) > 0 {
+		return classStatusForged
+	}
+	return classStatusUnsigned
+}
+
+// Truncated HMAC of the value, in hex
+func (cc *ClassCodec) signature(value string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:cc.config.SignatureLength]
+}
+
+// Percent-encodes the separator and the percent sign
+func escapeClassValue(value string, sep string) string {
+	var sb strings.Builder
+	for _, c := range []byte(value) {
+		if c == '%' || c == sep[0] {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// Parses the value of the Class attribute in versions 0 and 1, with format [V:1#]P:<plan>#C:<externalClientId>[#A:<addon>][#T:<reason>]
+// Unknown items are ignored. Returns an error if the value was not generated by this handler
+func decodeLegacyClass(class string) (ClassInfo, error) {
+
+	var ci ClassInfo
+	var version string
+	var found bool
+	for _, item := range strings.Split(class, "#") {
+		if len(item) < 2 || item[1] != ':' {
+			return ClassInfo{}, fmt.Errorf("bad item %s in Class %s", item, class)
+		}
+		value := item[2:]
+		switch item[0] {
+		case 'V':
+			version = value
+		case 'P':
+			ci.PlanName = value
+			found = true
+		case 'C':
+			ci.ExternalClientId = value
+			found = true
+		case 'A':
+			ci.AddonProfile = value
+		case 'T':
+			ci.SessionTimeoutReason = value
+		}
+	}
+
+	if version != "" && version != "1" {
+		return ClassInfo{}, fmt.Errorf("unsupported version %s in Class %s", version, class)
+	}
+	if !found {
+		return ClassInfo{}, fmt.Errorf("plan and client not found in Class %s", class)
+	}
+
+	return ci, nil
+}
+
+// Adds to the request the attributes decoded from the Class, so that they can be used in CDR writers
+// and copy targets, and the status of the verification of the signature
+func addClassAttributes(request *core.RadiusPacket, hl *core.HandlerLogger) {
+
+	l := hl.L
+
+	class := request.GetStringAVP("Class")
+	if class == "" {
+		return
+	}
+
+	ci, status := classCodec.Decode(class)
+	request.Add("PSA-ClassStatus", status)
+	incrementCounter("classStatus", status)
+	switch status {
+	case classStatusForged:
+		l.Warnf("forged Class %s", class)
+		return
+	case classStatusMangled:
+		// May have been generated by an upstream server
+		l.Debugf("mangled Class %s", class)
+		return
+	}
+
+	for _, attr := range []struct{ name, value string }{
+		{"PSA-PlanName", ci.PlanName},
+		{"PSA-ExternalClientId", ci.ExternalClientId},
+		{"PSA-ISP", ci.ISP},
+		{"PSA-AddonProfile", ci.AddonProfile},
+		{"PSA-SessionTimeoutReason", ci.SessionTimeoutReason},
+	} {
+		if attr.value != "" {
+			request.Add(attr.name, attr.value)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package psbahandlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClassEncoding(t *testing.T) {
+
+	codec, err := NewClassCodec(ClassCodecConfig{
+		Format:      []string{"P:plan", "C:externalClientId", "A:addon", "T:sessionTimeoutReason"},
+		SigningKeys: []ClassSigningKey{{Id: "new", Secret: "newsecret"}, {Id: "old", Secret: "oldsecret"}},
+	})
+	if err != nil {
+		t.Fatalf("could not create codec: %s", err)
+	}
+
+	// The separator in the values is escaped
+	ci := ClassInfo{PlanName: "Plan#1", ExternalClientId: "ext%1", AddonProfile: "pcautiv", SessionTimeoutReason: "blocking"}
+	class, complete := codec.Encode(ci)
+	if !complete {
+		t.Fatalf("Class truncated to %s", class)
+	}
+	if !strings.HasPrefix(class, "V:2#P:Plan%231#C:ext%251#A:pcautiv#T:blocking#S:new.") {
+		t.Errorf("encoded Class is %s", class)
+	}
+	if decoded, status := codec.Decode(class); status != classStatusValid || decoded != ci {
+		t.Errorf("decoded Class is %v with status %s", decoded, status)
+	}
+
+	// Key rotation. Signed with a key that is no longer the first one
+	oldCodec, _ := NewClassCodec(ClassCodecConfig{
+		Format:      []string{"P:plan", "C:externalClientId"},
+		SigningKeys: []ClassSigningKey{{Id: "old", Secret: "oldsecret"}},
+	})
+	oldClass, _ := oldCodec.Encode(ci)
+	if _, status := codec.Decode(oldClass); status != classStatusValid {
+		t.Errorf("Class signed with old key has status %s", status)
+	}
+
+	// Modified values and unknown keys
+	if _, status := codec.Decode(strings.Replace(class, "Plan%231", "Plan2", 1)); status != classStatusForged {
+		t.Errorf("modified Class has status %s", status)
+	}
+	if _, status := codec.Decode(strings.Replace(class, "S:new.", "S:other.", 1)); status != classStatusForged {
+		t.Errorf("Class with unknown key has status %s", status)
+	}
+
+	// Unsigned values are not accepted if signing keys are configured
+	for _, unsigned := range []string{"V:2#P:Plan2#C:ext2", strings.Split(class, "#S:")[0], "V:1#P:Plan3#C:ext3", "P:Plan2#C:ext2"} {
+		if _, status := codec.Decode(unsigned); status != classStatusForged {
+			t.Errorf("unsigned Class %s has status %s", unsigned, status)
+		}
+	}
+
+	// Unsigned and legacy formats
+	unsignedCodec, _ := NewClassCodec(ClassCodecConfig{Format: []string{"P:plan", "C:externalClientId"}})
+	if decoded, status := unsignedCodec.Decode("V:2#P:Plan2#C:ext2#X:future"); status != classStatusUnsigned || decoded.PlanName != "Plan2" {
+		t.Errorf("unsigned Class is %v with status %s", decoded, status)
+	}
+	decoded, status := unsignedCodec.Decode("P:Plan2#C:ext2#X:future")
+	if status != classStatusUnsigned || decoded.PlanName != "Plan2" || decoded.ExternalClientId != "ext2" || decoded.AddonProfile != "" {
+		t.Errorf("decoded unversioned Class is %v with status %s", decoded, status)
+	}
+	if decoded, status := unsignedCodec.Decode("V:1#P:Plan3#C:ext3"); status != classStatusUnsigned || decoded.PlanName != "Plan3" {
+		t.Errorf("decoded version 1 Class is %v with status %s", decoded, status)
+	}
+
+	for _, bad := range []string{"V:9#P:Plan1#C:ext1", "not a class", "V:1#A:addon", "V:2#P:Plan%zz"} {
+		if _, status := codec.Decode(bad); status != classStatusMangled {
+			t.Errorf("bad Class %s has status %s", bad, status)
+		}
+	}
+
+	// Unsigned values are not accepted if signature is required
+	strictCodec, _ := NewClassCodec(ClassCodecConfig{Format: []string{"P:plan"}, RequireSignature: true})
+	if _, status := strictCodec.Decode("V:2#P:Plan2"); status != classStatusForged {
+		t.Errorf("unsigned Class has status %s", status)
+	}
+
+	// Values too long for the attribute. The optional fields are removed first, keeping the signature
+	longCi := ClassInfo{PlanName: "Plan1", ExternalClientId: "ext1", AddonProfile: "pcautiv", SessionTimeoutReason: strings.Repeat("t", 250)}
+	if longClass, complete := codec.Encode(longCi); complete || len(longClass) > maxClassLength {
+		t.Errorf("long Class encoded as %s", longClass)
+	} else if decoded, status := codec.Decode(longClass); status != classStatusValid || decoded != (ClassInfo{PlanName: "Plan1", ExternalClientId: "ext1", AddonProfile: "pcautiv"}) {
+		t.Errorf("decoded long Class is %v with status %s", decoded, status)
+	}
+	if longClass, complete := codec.Encode(ClassInfo{PlanName: strings.Repeat("p", 250)}); complete || len(longClass) > maxClassLength {
+		t.Errorf("long Class encoded as %s", longClass)
+	} else if _, status := codec.Decode(longClass); status != classStatusValid {
+		t.Errorf("long Class has status %s", status)
+	}
+
+	// Secret taken from the environment
+	t.Setenv("PSBA_TEST_CLASS_KEY", "envsecret")
+	envCodec, err := NewClassCodec(ClassCodecConfig{Format: []string{"P:plan"}, SigningKeys: []ClassSigningKey{{Id: "env", SecretEnvironmentVariable: "PSBA_TEST_CLASS_KEY"}}})
+	if err != nil {
+		t.Fatalf("could not create codec: %s", err)
+	}
+	if envClass, _ := envCodec.Encode(ci); envClass != "V:2#P:Plan%231#S:env."+envCodec.signature("V:2#P:Plan%231", "envsecret") {
+		t.Errorf("Class signed with secret from environment is %s", envClass)
+	}
+
+	// Bad configurations
+	for _, config := range []ClassCodecConfig{
+		{Separator: ":", Format: []string{"P:plan"}},
+		{Format: []string{"P:unknown"}},
+		{Format: []string{"S:plan"}},
+		{Format: []string{"P:plan", "P:addon"}},
+		{Format: []string{"P:plan"}, SigningKeys: []ClassSigningKey{{Id: "k.1", Secret: "secret"}}},
+		{Format: []string{"P:plan"}, SigningKeys: []ClassSigningKey{{Id: strings.Repeat("k", 33), Secret: "secret"}}},
+		{Format: []string{"P:plan"}, SigningKeys: []ClassSigningKey{{Id: "k1", SecretEnvironmentVariable: "PSBA_UNDEFINED_CLASS_KEY"}}},
+	} {
+		if _, err := NewClassCodec(config); err == nil {
+			t.Errorf("bad codec configuration not detected %v", config)
+		}
+	}
+}
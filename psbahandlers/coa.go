@@ -0,0 +1,160 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Default destination port for dynamic authorization, as per RFC 5176
+const defaultCoAPort = 3799
+
+// Used if the session identifiers are not specified for the radius client type
+var defaultSessionIdentifiers = []string{"Acct-Session-Id", "NAS-IP-Address"}
+
+// Returned when the NAS answers with Disconnect-NAK or CoA-NAK
+type DynamicAuthorizationError struct {
+	// Code of the answer
+	Code byte
+
+	// Value of the Error-Cause attribute, if present
+	ErrorCause string
+}
+
+func (e *DynamicAuthorizationError) Error() string {
+	if e.ErrorCause == "" {
+		return fmt.Sprintf("nak received with code %d", e.Code)
+	}
+	return fmt.Sprintf("nak received with code %d and cause %s", e.Code, e.ErrorCause)
+}
+
+// Sends a Disconnect-Request for the session to the NAS that owns it
+func DisconnectSession(acctSessionId string, nas string) error {
+	return sendDynamicAuthorization(core.DISCONNECT_REQUEST, acctSessionId, nas, nil)
+}
+
+// Sends a CoA-Request with the specified attributes for the session to the NAS that owns it
+func ChangeSessionAuthorization(acctSessionId string, nas string, avps []core.RadiusAVP) error {
+	return sendDynamicAuthorization(core.COA_REQUEST, acctSessionId, nas, avps)
+}
+
+// Builds the request with the attributes identifying the session and sends it to the CoA port of the NAS.
+// If the NAS answers that the session does not exist, the session is removed from the store
+func sendDynamicAuthorization(code byte, acctSessionId string, nas string, avps []core.RadiusAVP) error {
+
+	session, found := sessionStore.Get(acctSessionId, nas)
+	if !found {
+		return fmt.Errorf("session %s not found", sessionKey(acctSessionId, nas))
+	}
+
+	destination, secret, err := coaDestination(session)
+	if err != nil {
+		return err
+	}
+
+	request := core.NewRadiusRequest(code)
+	identifiers := radiusClientTypes.Get()[session.RadiusClientType].SessionIdentifiers
+	if len(identifiers) == 0 {
+		identifiers = defaultSessionIdentifiers
+	}
+	for _, attrName := range identifiers {
+		for _, avp := range session.lastRequest.GetAllAVP(attrName) {
+			request.AddAVP(&avp)
+		}
+	}
+	if session.NASIPAddress == "" {
+		request.Add("NAS-Identifier", session.NASIdentifier)
+	}
+	request.AddAVPs(avps)
+
+	hc := handlerConfig.Get()
+	timeoutMillis := hc.CoATimeoutMillis
+	if timeoutMillis <= 0 {
+		timeoutMillis = 2000
+	}
+
+	// Timeouts are retried by the router
+	response, err := radiusRouter.RouteRadiusRequest(request, destination, time.Duration(timeoutMillis)*time.Millisecond, 1, 1+hc.CoARetries, secret)
+	if err != nil {
+		incrementCounter("dynamicAuthorization", "timeout")
+		return fmt.Errorf("could not send request to %s: %w", destination, err)
+	}
+
+	if response.Code != code+1 {
+		incrementCounter("dynamicAuthorization", "nak")
+		nakErr := &DynamicAuthorizationError{Code: response.Code, ErrorCause: response.GetStringAVP("Error-Cause")}
+		if nakErr.ErrorCause == "Session-Context-Not-Found" {
+			sessionStore.Remove(acctSessionId, nas)
+		}
+		return nakErr
+	}
+
+	incrementCounter("dynamicAuthorization", "ack")
+	if code == core.DISCONNECT_REQUEST {
+		sessionStore.Remove(acctSessionId, nas)
+	}
+
+	return nil
+}
+
+// Returns the endpoint and secret to send dynamic authorization requests for the session. The NAS is looked
+// for in the radius servers configuration by IP address, or by name if only the NAS-Identifier is known. If
+// not found there, the secret of the radius client and the default port are used
+func coaDestination(session Session) (string, string, error) {
+
+	for name, server := range confMgr.RadiusServers().Servers {
+		if (session.NASIPAddress != "" && server.IPAddress == session.NASIPAddress) || (session.NASIPAddress == "" && name == session.NASIdentifier) {
+			port := server.COAPort
+			if port == 0 {
+				port = defaultCoAPort
+			}
+			return fmt.Sprintf("%s:%d", server.IPAddress, port), server.Secret, nil
+		}
+	}
+
+	if client, found := confMgr.RadiusClients()[session.NASIPAddress]; found {
+		return fmt.Sprintf("%s:%d", session.NASIPAddress, defaultCoAPort), client.Secret, nil
+	}
+
+	return "", "", fmt.Errorf("no coa destination for nas %s", session.nas())
+}
+
+// Sends a Disconnect-Request, or a CoA-Request if the "action" query parameter is "coa", for the session
+// specified in the "acctSessionId" and "nas" query parameters. The attributes of the CoA are posted in the
+// body, as in [{"Session-Timeout": 3600}]. Only POST is allowed
+func coaAdminHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	acctSessionId, nas := query.Get("acctSessionId"), query.Get("nas")
+
+	var err error
+	switch query.Get("action") {
+	case "", "disconnect":
+		err = DisconnectSession(acctSessionId, nas)
+	case "coa":
+		var avps []core.RadiusAVP
+		if err := json.NewDecoder(req.Body).Decode(&avps); err != nil {
+			http.Error(w, "bad coa attributes: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = ChangeSessionAuthorization(acctSessionId, nas, avps)
+	default:
+		http.Error(w, "unknown action "+query.Get("action"), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		core.GetLogger().Infof("dynamic authorization for %s failed: %s", sessionKey(acctSessionId, nas), err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	writeJSONResponse(w, map[string]string{"result": "ack"})
+}
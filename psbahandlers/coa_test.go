@@ -0,0 +1,49 @@
+package psbahandlers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestDynamicAuthorization(t *testing.T) {
+
+	// The superserver plays the role of the NAS, since it is defined in the radius servers of the psba
+	for i, userName := range []string{"coa@database", "rejectcoa@database"} {
+		request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+			Add("NAS-IP-Address", "127.0.0.1").
+			Add("NAS-Port", 9993).
+			Add("User-Name", userName).
+			Add("Acct-Session-Id", "coa-session-"+userName).
+			Add("Acct-Status-Type", "Start")
+		if _, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+			t.Fatalf("could not send accounting start %d: %s", i, err)
+		}
+	}
+
+	if err := ChangeSessionAuthorization("coa-session-coa@database", "127.0.0.1", []core.RadiusAVP{}); err != nil {
+		t.Errorf("coa not acknowledged: %s", err)
+	}
+
+	var nakErr *DynamicAuthorizationError
+	err := ChangeSessionAuthorization("coa-session-rejectcoa@database", "127.0.0.1", nil)
+	if !errors.As(err, &nakErr) || nakErr.Code != core.COA_REQUEST+2 {
+		t.Errorf("coa nak not reported: %v", err)
+	}
+
+	if err := DisconnectSession("non-existing-session", "127.0.0.1"); err == nil {
+		t.Error("disconnect of unknown session did not fail")
+	}
+
+	// Through the administrative API
+	resp, err := http2Client.Post("https://localhost:9191/coa?action=coa&nas=127.0.0.1&acctSessionId=coa-session-coa@database", "application/json", nil)
+	if err != nil {
+		t.Fatalf("could not send coa through the api: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("coa without attributes accepted with status %d", resp.StatusCode)
+	}
+}
@@ -17,12 +17,14 @@ type DatabaseConfig struct {
 	// MaxIdleConns is evil. Connections are closed instead of being reused constantly
 }
 
-type PlanTemplateParams struct {
-	Speed   int
-	Message string
-}
-
 type CDRWriter struct {
+	// Used to refer to the writer in the CDRWriterNames configuration property
+	Name string
+
+	// If true, only used for the requests whose configuration includes the writer in CDRWriterNames,
+	// typically those of a wholesale ISP
+	OnDemand bool
+
 	Path            string
 	FileNamePattern string
 	Format          string
@@ -52,6 +54,30 @@ type CopyTarget struct {
 
 	// Tries for each server in proxy group
 	ProxyServerRetries int
+
+	// Whether to store the copies that could not be sent in a spool on disk, to be sent again when the
+	// proxy group recovers
+	Spool bool
+
+	// Limits of the spool. When exceeded, the oldest records are discarded. Zero means no limit
+	SpoolMaxBytes      int64
+	SpoolMaxAgeSeconds int
+}
+
+// Treatment of users with a specific blocking status
+type BlockingStatus struct {
+	// Only for logging purposes
+	Name string
+
+	// Profile to assign. If empty, the user is rejected
+	Profile string
+	IsAddon bool
+
+	// If not zero, sent as Session-Timeout, so that the user re-authenticates and picks up any unblock
+	SessionTimeoutSeconds int
+
+	// If not empty, sent as Reply-Message
+	ReplyMessage string
 }
 
 type HandlerConfig struct {
@@ -61,6 +87,9 @@ type HandlerConfig struct {
 	WriteServiceCDR    bool
 	CdrFilenamePattern string
 
+	// Comma separated names of the on demand CDR writers to use
+	CDRWriterNames string
+
 	// Accounting Copy
 	CopyTargets []CopyTarget
 
@@ -70,6 +99,12 @@ type HandlerConfig struct {
 	ProxySessionAccounting bool
 	ProxyServiceAccounting bool
 
+	// If true, the Accounting-Response is sent only if the inline proxy succeeds, so that the NAS retries. If
+	// AcctProxySpool is also true, the requests that could not be proxied are instead stored in a spool on disk,
+	// under SpoolDirectory, and sent again in order when the proxy group recovers
+	AcctProxyMustSucceed bool
+	AcctProxySpool       bool
+
 	// Normally overriden in a per-domain basis
 	ProxyTimeoutMillis int
 	ProxyRetries       int
@@ -94,6 +129,10 @@ type HandlerConfig struct {
 	BlockingIsAddon               bool
 	BlockingSessionTimeoutSeconds int
 
+	// Treatment for each blocking status code. Not overridable in realm or client configuration.
+	// Status 2, if not specified here, uses the Blocking properties above
+	BlockingStatuses map[int]BlockingStatus
+
 	// To be used in the domain configuration, to override the basic profile
 	RealmProfile string
 
@@ -101,6 +140,64 @@ type HandlerConfig struct {
 	NotificationProfile string
 	NotificationIsAddon bool
 
+	// Whether to cap the Session-Timeout to the earliest expiration date of the overrides in effect,
+	// plus a random value up to SessionTimeoutJitterSeconds, so that the user re-authenticates after expiration
+	AlignSessionTimeoutToExpiry bool
+	SessionTimeoutJitterSeconds int
+
+	// Local pools from which to assign Framed-IP-Address and Delegated-IPv6-Prefix, if not already assigned.
+	// The pools specified in the plan parameters LocalIPv4Pool and LocalIPv6PrefixPool take precedence
+	LocalIPv4Pool       string
+	LocalIPv6PrefixPool string
+
+	// Number of decision traces of Access-Requests to keep for each user name and access line, retrievable
+	// through the administrative API. Zero disables the storage. Not overridable in realm or client configuration
+	DecisionTracesPerUser int
+	// Maximum number of user names and access lines for which traces are kept. Defaults to 10000
+	DecisionTracesMaxUsers int
+
+	// Name of the set of L2TP Network Servers to which the sessions are tunneled, typically for a realm or ISP
+	LNSSet string
+
+	// Timeout and retries for the CoA-Request and Disconnect-Request sent to the NAS. Not overridable in realm
+	// or client configuration. The timeout defaults to 2000
+	CoATimeoutMillis int
+	CoARetries       int
+
+	// Sessions without accounting during SessionReaperIntervalMultiple times their Acct-Interim-Interval, or
+	// SessionReaperDefaultIntervalSeconds if not reported, are closed with a synthetic stop. Zero values disable
+	// the reaping. If SessionReaperDisconnect is true, a Disconnect-Request is sent first and, if acknowledged,
+	// the session is removed without synthetic stop, since the NAS sends its own. The check is done every
+	// SessionReaperCheckSeconds, which defaults to 60. Not overridable in realm or client configuration
+	SessionReaperIntervalMultiple       int
+	SessionReaperDefaultIntervalSeconds int
+	SessionReaperCheckSeconds           int
+	SessionReaperDisconnect             bool
+
+	// Accounting requests identical to one answered within this number of seconds are acknowledged but not
+	// treated, and those identical to one still being processed are dropped. Zero disables the detection. Not
+	// overridable in realm or client configuration
+	DuplicateAccountingWindowSeconds int
+
+	// Directory under which the spools of the copy targets are created, one for each target, and interval
+	// between attempts to send the spooled records, which defaults to 10
+	SpoolDirectory    string
+	SpoolRetrySeconds int
+
+	// If true, the session accounting is also written to the accountingsessions and dailyusage tables of the
+	// clients database. The writes are done asynchronously, in batches of DatabaseAccountingBatchSize records
+	// (default 100) or every DatabaseAccountingBatchMillis (default 1000), with up to DatabaseAccountingQueueSize
+	// records waiting (default 10000). The batches that can not be written are retried, and the records are
+	// only discarded when still failing after some minutes. Not overridable in realm or client configuration
+	DatabaseAccounting            bool
+	DatabaseAccountingBatchSize   int
+	DatabaseAccountingBatchMillis int
+	DatabaseAccountingQueueSize   int
+
+	// Time zone in which the billing cycles of the clients start, as an IANA name such as "Europe/Madrid".
+	// Defaults to the local time zone. Not overridable in realm or client configuration
+	BillingTimeZone string
+
 	// Global Radius attributes to send
 	RadiusAttrs               []core.RadiusAVP
 	NonOverridableRadiusAttrs []core.RadiusAVP
@@ -117,6 +214,45 @@ func (g HandlerConfig) String() string {
 	return jBytes.String()
 }
 
+// Returns the treatment for the specified blocking status, or false if the status does not imply blocking
+func (g HandlerConfig) GetBlockingStatus(status int) (BlockingStatus, bool) {
+	if bs, found := g.BlockingStatuses[status]; found {
+		return bs, true
+	}
+
+	if status == 2 {
+		return BlockingStatus{
+			Name:                  "blocked",
+			Profile:               g.BlockingProfile,
+			IsAddon:               g.BlockingIsAddon,
+			SessionTimeoutSeconds: g.BlockingSessionTimeoutSeconds,
+		}, true
+	}
+
+	return BlockingStatus{}, false
+}
+
+// Returns the names of the on demand CDR writers to use
+func (g HandlerConfig) GetCDRWriterNames() []string {
+	var names []string
+	for _, name := range strings.Split(g.CDRWriterNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Whether the on demand CDR writer is to be used
+func (g HandlerConfig) UsesCDRWriter(name string) bool {
+	for _, n := range g.GetCDRWriterNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Overrides the configuration properties with other taken from userfile config items
 func (g HandlerConfig) OverrideWith(props handler.Properties, hl *core.HandlerLogger) HandlerConfig {
 
@@ -138,6 +274,10 @@ func (g HandlerConfig) OverrideWith(props handler.Properties, hl *core.HandlerLo
 			} else {
 				l.Errorf("bad format for WriteServiceCDR %s", props[key])
 			}
+		case "lnsset":
+			g.LNSSet = props[key]
+		case "cdrwriternames":
+			g.CDRWriterNames = props[key]
 		case "proxygroupname":
 			g.ProxyGroupName = props[key]
 		case "acceptonproxyerror":
@@ -146,6 +286,18 @@ func (g HandlerConfig) OverrideWith(props handler.Properties, hl *core.HandlerLo
 			} else {
 				l.Errorf("bad format for AcceptOnProxyError %s", props[key])
 			}
+		case "acctproxymustsucceed":
+			if v, err := strconv.ParseBool(props[key]); err == nil {
+				g.AcctProxyMustSucceed = v
+			} else {
+				l.Errorf("bad format for AcctProxyMustSucceed %s", props[key])
+			}
+		case "acctproxyspool":
+			if v, err := strconv.ParseBool(props[key]); err == nil {
+				g.AcctProxySpool = v
+			} else {
+				l.Errorf("bad format for AcctProxySpool %s", props[key])
+			}
 		case "proxysessionaccounting":
 			if v, err := strconv.ParseBool(props[key]); err == nil {
 				g.ProxySessionAccounting = v
@@ -214,6 +366,22 @@ func (g HandlerConfig) OverrideWith(props handler.Properties, hl *core.HandlerLo
 			} else {
 				l.Errorf("bad format for NotificationIsAddon %s", props[key])
 			}
+		case "alignsessiontimeouttoexpiry":
+			if v, err := strconv.ParseBool(props[key]); err == nil {
+				g.AlignSessionTimeoutToExpiry = v
+			} else {
+				l.Errorf("bad format for AlignSessionTimeoutToExpiry %s", props[key])
+			}
+		case "sessiontimeoutjitterseconds":
+			if v, err := strconv.ParseInt(props[key], 10, 32); err == nil {
+				g.SessionTimeoutJitterSeconds = int(v)
+			} else {
+				l.Errorf("bad format for SessionTimeoutJitterSeconds %s", props[key])
+			}
+		case "localipv4pool":
+			g.LocalIPv4Pool = props[key]
+		case "localipv6prefixpool":
+			g.LocalIPv6PrefixPool = props[key]
 		}
 	}
 
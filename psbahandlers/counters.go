@@ -0,0 +1,118 @@
+package psbahandlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Counters of events specific to this handler, not covered by the igor metrics, such as
+// the result of the verification of the Class attribute or the duplicate accounting requests.
+// Indexed by counter name and label. Exported in JSON in /counters and in Prometheus format in /metrics,
+// to be scraped along with the igor metrics
+type handlerCounters struct {
+	sync.Mutex
+	values map[string]map[string]uint64
+}
+
+var counters = handlerCounters{values: make(map[string]map[string]uint64)}
+
+// Adds one to the counter with the specified name and label
+func incrementCounter(name string, label string) {
+	counters.Lock()
+	defer counters.Unlock()
+
+	if counters.values[name] == nil {
+		counters.values[name] = make(map[string]uint64)
+	}
+	counters.values[name][label]++
+}
+
+// Returns a copy of the current values of the counters
+func getCounters() map[string]map[string]uint64 {
+	counters.Lock()
+	defer counters.Unlock()
+
+	values := make(map[string]map[string]uint64, len(counters.values))
+	for name, labels := range counters.values {
+		values[name] = make(map[string]uint64, len(labels))
+		for label, value := range labels {
+			values[name][label] = value
+		}
+	}
+
+	return values
+}
+
+// Returns the values of the handler counters. If the "name" query parameter is specified,
+// only that counter is returned
+func countersAdminHandler(w http.ResponseWriter, req *http.Request) {
+	values := getCounters()
+
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		writeJSONResponse(w, values)
+		return
+	}
+
+	if labels, found := values[name]; found {
+		writeJSONResponse(w, labels)
+	} else {
+		writeJSONResponse(w, map[string]uint64{})
+	}
+}
+
+// Escapes the label values as required by the Prometheus text format
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Name of the Prometheus metric for the counter, such as psba_duplicate_accounting for duplicateAccounting
+func prometheusMetricName(counterName string) string {
+	var sb strings.Builder
+	sb.WriteString("psba_")
+	for _, c := range counterName {
+		switch {
+		case unicode.IsUpper(c):
+			sb.WriteByte('_')
+			sb.WriteRune(unicode.ToLower(c))
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			sb.WriteRune(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// Returns the values of the handler counters in Prometheus text format, sorted by name and label.
+// The label of each counter is exported as "label"
+func metricsAdminHandler(w http.ResponseWriter, req *http.Request) {
+	values := getCounters()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		metricName := prometheusMetricName(name)
+		fmt.Fprintf(&sb, "# HELP %s psba handler counter %s\n", metricName, name)
+		fmt.Fprintf(&sb, "# TYPE %s counter\n", metricName)
+
+		labels := make([]string, 0, len(values[name]))
+		for label := range values[name] {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			fmt.Fprintf(&sb, "%s{label=\"%s\"} %d\n", metricName, prometheusLabelEscaper.Replace(label), values[name][label])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(sb.String()))
+}
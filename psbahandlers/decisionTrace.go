@@ -0,0 +1,204 @@
+package psbahandlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Structured record of the decisions taken while processing an Access-Request, so that support
+// can find out why a subscriber got a specific treatment without digging through the logs
+type DecisionTrace struct {
+	Timestamp        time.Time
+	UserName         string
+	AccessLine       string
+	Realm            string
+	RadiusClientType string
+
+	// How the client was looked for, such as "database accessId=10.0.0.1 accessPort=1"
+	LookupKey        string
+	ClientFound      bool
+	ExternalClientId string `json:",omitempty"`
+	ClientPlanName   string `json:",omitempty"`
+	BlockingStatus   int    `json:",omitempty"`
+
+	// Overrides and other treatments applied, in order
+	Overrides []string
+
+	// Result of the proxy to the upstream server, if any
+	ProxyOutcome string `json:",omitempty"`
+
+	// Final plan and profiles merged
+	PlanName     string `json:",omitempty"`
+	BasicProfile string `json:",omitempty"`
+	AddonProfile string `json:",omitempty"`
+
+	// "accept", "reject" or "error"
+	Result       string
+	RejectReason string           `json:",omitempty"`
+	Error        string           `json:",omitempty"`
+	Attributes   []core.RadiusAVP `json:",omitempty"`
+
+	// Names of the attributes of the response not stored in Attributes because they hold secrets
+	RedactedAttributes []string `json:",omitempty"`
+}
+
+// Creates a trace for the request
+func newDecisionTrace(ctx *RequestContext) *DecisionTrace {
+	return &DecisionTrace{
+		Timestamp:        time.Now(),
+		UserName:         ctx.userName,
+		AccessLine:       ctx.accessLine(),
+		Realm:            ctx.realm,
+		RadiusClientType: ctx.radiusClientType,
+		Overrides:        make([]string, 0),
+	}
+}
+
+// Records an override or other treatment applied
+func (t *DecisionTrace) addOverride(format string, args ...any) {
+	t.Overrides = append(t.Overrides, fmt.Sprintf(format, args...))
+}
+
+// Records the final result
+func (t *DecisionTrace) complete(response *core.RadiusPacket, err error) {
+	switch {
+	case err != nil:
+		t.Result = "error"
+		t.Error = err.Error()
+	case response.Code == core.ACCESS_REJECT:
+		t.Result = "reject"
+		t.setAttributes(response.AVPs)
+	default:
+		t.Result = "accept"
+		t.setAttributes(response.AVPs)
+	}
+}
+
+// Stores the attributes of the response, except those that hold secrets, which are the ones salted or
+// encrypted in the dictionary and the passwords, that are recorded only by name
+func (t *DecisionTrace) setAttributes(avps []core.RadiusAVP) {
+	t.Attributes = make([]core.RadiusAVP, 0, len(avps))
+	for _, avp := range avps {
+		if isSecretAttribute(&avp) {
+			t.RedactedAttributes = append(t.RedactedAttributes, avp.Name)
+		} else {
+			t.Attributes = append(t.Attributes, avp)
+		}
+	}
+}
+
+func isSecretAttribute(avp *core.RadiusAVP) bool {
+	if avp.DictItem != nil && (avp.DictItem.Salted || avp.DictItem.Encrypted) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(avp.Name), "password")
+}
+
+// Keeps the last traces for each user name and access line
+type DecisionTraceStore struct {
+	sync.Mutex
+
+	// Number of traces to keep for each user name and access line. If zero, the traces are not stored
+	size int
+
+	// Maximum number of user names and access lines. When reached, the oldest ones are discarded
+	maxKeys int
+
+	byUserName   map[string][]*DecisionTrace
+	byAccessLine map[string][]*DecisionTrace
+
+	// In order of insertion, to discard the oldest
+	userNames   []string
+	accessLines []string
+}
+
+var decisionTraces *DecisionTraceStore
+
+// Creates the store of traces
+func NewDecisionTraceStore(size int, maxKeys int) *DecisionTraceStore {
+	if maxKeys == 0 {
+		maxKeys = 10000
+	}
+	return &DecisionTraceStore{
+		size:         size,
+		maxKeys:      maxKeys,
+		byUserName:   make(map[string][]*DecisionTrace),
+		byAccessLine: make(map[string][]*DecisionTrace),
+	}
+}
+
+// Stores the trace
+func (s *DecisionTraceStore) Add(trace *DecisionTrace) {
+	if s == nil || s.size == 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.userNames = s.addTo(s.byUserName, s.userNames, trace.UserName, trace)
+	s.accessLines = s.addTo(s.byAccessLine, s.accessLines, trace.AccessLine, trace)
+}
+
+// Helper to add a trace to one of the indexes, returning the updated list of keys
+func (s *DecisionTraceStore) addTo(traces map[string][]*DecisionTrace, keys []string, key string, trace *DecisionTrace) []string {
+	current, found := traces[key]
+	if !found {
+		keys = append(keys, key)
+		if len(keys) > s.maxKeys {
+			delete(traces, keys[0])
+			keys = keys[1:]
+		}
+	}
+
+	current = append(current, trace)
+	if len(current) > s.size {
+		current = current[len(current)-s.size:]
+	}
+	traces[key] = current
+
+	return keys
+}
+
+// Returns the traces for the user name or access line, most recent first
+func (s *DecisionTraceStore) Get(userName string, accessLine string) []*DecisionTrace {
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var traces []*DecisionTrace
+	if userName != "" {
+		traces = s.byUserName[userName]
+	} else {
+		traces = s.byAccessLine[accessLine]
+	}
+
+	result := make([]*DecisionTrace, 0, len(traces))
+	for i := len(traces) - 1; i >= 0; i-- {
+		result = append(result, traces[i])
+	}
+
+	return result
+}
+
+// Returns the last decision traces for the user specified in the "userName" query parameter or
+// the access line specified in the "accessLine" parameter, as <accessId>:<accessPort>
+func tracesAdminHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	userName := strings.ToLower(query.Get("userName"))
+	accessLine := query.Get("accessLine")
+	if userName == "" && accessLine == "" {
+		http.Error(w, "userName or accessLine must be specified", http.StatusBadRequest)
+		return
+	}
+
+	writeJSONResponse(w, decisionTraces.Get(userName, accessLine))
+}
@@ -0,0 +1,56 @@
+package psbahandlers
+
+import (
+	"testing"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestDecisionTraceStore(t *testing.T) {
+
+	store := NewDecisionTraceStore(2, 2)
+	for i, key := range []struct{ user, line string }{{"user1", "line1"}, {"user1", "line1"}, {"user1", "line1"}, {"user2", "line2"}, {"user3", "line3"}} {
+		store.Add(&DecisionTrace{UserName: key.user, AccessLine: key.line, BlockingStatus: i})
+	}
+
+	// Only the oldest users are discarded
+	if traces := store.Get("user1", ""); len(traces) != 0 {
+		t.Errorf("traces for discarded user %v", traces)
+	}
+	if traces := store.Get("", "line3"); len(traces) != 1 {
+		t.Errorf("traces for access line %v", traces)
+	}
+
+	// Only the last traces are kept, most recent first
+	store = NewDecisionTraceStore(2, 0)
+	for i := 0; i < 3; i++ {
+		store.Add(&DecisionTrace{UserName: "user", AccessLine: "line", BlockingStatus: i})
+	}
+	traces := store.Get("user", "")
+	if len(traces) != 2 || traces[0].BlockingStatus != 2 || traces[1].BlockingStatus != 1 {
+		t.Errorf("traces for user %v", traces)
+	}
+
+	// Storage disabled
+	store = NewDecisionTraceStore(0, 0)
+	store.Add(&DecisionTrace{UserName: "user", AccessLine: "line"})
+	if traces := store.Get("user", ""); len(traces) != 0 {
+		t.Errorf("traces stored while disabled %v", traces)
+	}
+}
+
+func TestDecisionTraceRedaction(t *testing.T) {
+
+	response := core.NewRadiusRequest(core.ACCESS_ACCEPT).
+		Add("Tunnel-Password", "736563726574:1").
+		Add("Class", "theClass")
+
+	trace := DecisionTrace{}
+	trace.complete(response, nil)
+	if len(trace.Attributes) != 1 || trace.Attributes[0].Name != "Class" {
+		t.Errorf("bad attributes in trace %v", trace.Attributes)
+	}
+	if len(trace.RedactedAttributes) != 1 || trace.RedactedAttributes[0] != "Tunnel-Password" {
+		t.Errorf("bad redacted attributes in trace %v", trace.RedactedAttributes)
+	}
+}
@@ -0,0 +1,90 @@
+package psbahandlers
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/francistor/igor/core"
+)
+
+// Values of the AccessType field of the PoU, that determine the IP versions used by the access line.
+// Other values are not valid, and the clients that have them are rejected
+const (
+	accessTypeDualStack = 0
+	accessTypeIPv4Only  = 1
+	accessTypeIPv6Only  = 2
+)
+
+// Whether the value of AccessType is one of the defined
+func validAccessType(accessType int) bool {
+	return accessType == accessTypeDualStack || accessType == accessTypeIPv4Only || accessType == accessTypeIPv6Only
+}
+
+// Attributes that are removed from the responses to IPv6 only access lines
+var ipv4Attributes = []string{
+	"Framed-IP-Address",
+	"Framed-IP-Netmask",
+	"Framed-Pool",
+}
+
+// Attributes that are removed from the responses to IPv4 only access lines
+var ipv6Attributes = []string{
+	"Framed-IPv6-Prefix",
+	"Framed-Interface-Id",
+	"Framed-IPv6-Pool",
+	"Framed-IPv6-Address",
+	"Delegated-IPv6-Prefix",
+	"Delegated-IPv6-Prefix-Pool",
+	"DNS-Server-IPv6-Address",
+}
+
+// Parses a prefix such as 2001:db8::/56 and verifies that it is a valid IPv6 prefix.
+// Returns the normalized prefix, that is, with the host bits set to zero
+func parseIPv6Prefix(prefix string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", prefix)
+	}
+
+	return ipNet, nil
+}
+
+// Parses the WAN prefix provisioned for the access line, returning the values for the
+// Framed-IPv6-Prefix and Framed-Interface-Id attributes. The WAN prefix may be specified
+// including the address of the CPE, such as 2001:db8:1:1::1/64, and in that case the lower
+// 64 bits are used as the interface id. Otherwise, the returned interface id is empty
+func parseWANPrefix(wanPrefix string) (string, string, error) {
+	ip, ipNet, err := net.ParseCIDR(wanPrefix)
+	if err != nil {
+		return "", "", err
+	}
+	if ip.To4() != nil {
+		return "", "", fmt.Errorf("%s is not an IPv6 prefix", wanPrefix)
+	}
+
+	var interfaceId string
+	if ones, _ := ipNet.Mask.Size(); ones == 64 && !ip.Equal(ipNet.IP) {
+		interfaceId = hex.EncodeToString(ip.To16()[8:])
+	}
+
+	return ipNet.String(), interfaceId, nil
+}
+
+// Removes the attributes of the IP version not used by the access line
+func filterByAccessType(response *core.RadiusPacket, accessType int) {
+	var toRemove []string
+	switch accessType {
+	case accessTypeIPv4Only:
+		toRemove = ipv6Attributes
+	case accessTypeIPv6Only:
+		toRemove = ipv4Attributes
+	}
+
+	for _, attrName := range toRemove {
+		response.DeleteAllAVP(attrName)
+	}
+}
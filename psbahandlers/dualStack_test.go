@@ -0,0 +1,61 @@
+package psbahandlers
+
+import (
+	"testing"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestIPv6Prefixes(t *testing.T) {
+
+	prefix, interfaceId, err := parseWANPrefix("2001:db8:1:1::1/64")
+	if err != nil {
+		t.Fatalf("could not parse WAN prefix: %s", err)
+	}
+	if prefix != "2001:db8:1:1::/64" || interfaceId != "0000000000000001" {
+		t.Errorf("WAN prefix is %s and interface id is %s", prefix, interfaceId)
+	}
+
+	if _, interfaceId, _ := parseWANPrefix("2001:db8:1:1::/64"); interfaceId != "" {
+		t.Errorf("interface id is %s", interfaceId)
+	}
+
+	for _, bad := range []string{"2001:db8:1:1::1", "10.0.0.0/8", "2001:db8::/129", "nonsense"} {
+		if _, _, err := parseWANPrefix(bad); err == nil {
+			t.Errorf("bad WAN prefix %s not detected", bad)
+		}
+		if _, err := parseIPv6Prefix(bad); err == nil {
+			t.Errorf("bad prefix %s not detected", bad)
+		}
+	}
+}
+
+func TestFilterByAccessType(t *testing.T) {
+
+	response := core.NewRadiusRequest(core.ACCESS_ACCEPT).
+		Add("Framed-IP-Address", "192.168.1.1").
+		Add("Framed-IPv6-Prefix", "2001:db8::/64").
+		Add("Delegated-IPv6-Prefix", "2001:db8:1::/56")
+
+	filterByAccessType(response, accessTypeDualStack)
+	if len(response.AVPs) != 3 {
+		t.Errorf("attributes removed for dual stack access: %v", response.AVPs)
+	}
+
+	v4 := response.Copy(nil, nil)
+	filterByAccessType(v4, accessTypeIPv4Only)
+	if len(v4.AVPs) != 1 || v4.GetStringAVP("Framed-IP-Address") == "" {
+		t.Errorf("attributes for ipv4 only access are %v", v4.AVPs)
+	}
+
+	v6 := response.Copy(nil, nil)
+	filterByAccessType(v6, accessTypeIPv6Only)
+	if len(v6.AVPs) != 2 || v6.GetStringAVP("Framed-IP-Address") != "" {
+		t.Errorf("attributes for ipv6 only access are %v", v6.AVPs)
+	}
+	for accessType, valid := range map[int]bool{accessTypeDualStack: true, accessTypeIPv4Only: true, accessTypeIPv6Only: true, 3: false, -1: false} {
+		if validAccessType(accessType) != valid {
+			t.Errorf("access type %d valid is not %t", accessType, valid)
+		}
+	}
+}
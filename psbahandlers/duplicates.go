@@ -0,0 +1,148 @@
+package psbahandlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Difference between the event times of two accounting requests with the same contents to consider them
+// duplicates. When the Event-Timestamp is not present, the event time is estimated using the Acct-Delay-Time,
+// which the NAS increments in the retransmissions, and is thus subject to rounding
+const duplicateEventTolerance = 1 * time.Second
+
+type acctFingerprint struct {
+	eventTime time.Time
+	received  time.Time
+
+	// False while the first copy is being processed
+	answered bool
+}
+
+// Results of the duplicate check
+const (
+	duplicateStatusNew       = "new"
+	duplicateStatusAnswered  = "answered"
+	duplicateStatusInProcess = "inProcess"
+)
+
+// Detects the accounting requests already received within the window, typically retransmissions of the NAS
+// or copies looping back. The requests are considered duplicates if they have the same Acct-Session-Id, NAS,
+// Acct-Status-Type, event time and counters. Requests without Acct-Session-Id are never duplicates. The
+// requests are recorded when received, and marked as answered when the processing succeeds, so that the
+// retransmissions received while the first copy is being processed are not acknowledged
+type DuplicateDetector struct {
+	sync.Mutex
+
+	window time.Duration
+
+	// The key is built from the contents of the request, except the event time
+	seen map[string]acctFingerprint
+
+	// Keys in the order received, to expire them
+	keys []string
+}
+
+var duplicateDetector *DuplicateDetector
+
+// Creates the detector. A zero window disables the detection
+func NewDuplicateDetector(windowSeconds int) *DuplicateDetector {
+	return &DuplicateDetector{
+		window: time.Duration(windowSeconds) * time.Second,
+		seen:   make(map[string]acctFingerprint),
+	}
+}
+
+// Returns whether the request has already been received within the window and, in that case, whether it was
+// answered or is still being processed. If not received, it is recorded as being processed, and must be marked
+// as answered or forgotten when done. A nil receiver never reports duplicates
+func (d *DuplicateDetector) Check(request *core.RadiusPacket, now time.Time) string {
+	if d == nil || d.window == 0 || request.GetStringAVP("Acct-Session-Id") == "" {
+		return duplicateStatusNew
+	}
+
+	key := duplicateKey(request)
+
+	eventTime := request.GetDateAVP("Event-Timestamp")
+	if eventTime.IsZero() {
+		eventTime = now.Add(-time.Duration(request.GetIntAVP("Acct-Delay-Time")) * time.Second)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.expire(now)
+
+	if previous, found := d.seen[key]; found && now.Sub(previous.received) <= d.window {
+		diff := eventTime.Sub(previous.eventTime)
+		if diff <= duplicateEventTolerance && diff >= -duplicateEventTolerance {
+			if previous.answered {
+				return duplicateStatusAnswered
+			}
+			return duplicateStatusInProcess
+		}
+	} else if !found {
+		d.keys = append(d.keys, key)
+	}
+	d.seen[key] = acctFingerprint{eventTime: eventTime, received: now}
+
+	return duplicateStatusNew
+}
+
+// Marks the request as answered, so that the retransmissions are acknowledged
+func (d *DuplicateDetector) Answered(request *core.RadiusPacket) {
+	if d == nil || d.window == 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	key := duplicateKey(request)
+	if fp, found := d.seen[key]; found {
+		fp.answered = true
+		d.seen[key] = fp
+	}
+}
+
+// Forgets the request, so that a retransmission is not considered duplicate, typically because the
+// request was not answered
+func (d *DuplicateDetector) Forget(request *core.RadiusPacket) {
+	if d == nil || d.window == 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	// The key is removed from the list on expiration
+	delete(d.seen, duplicateKey(request))
+}
+
+// Builds the key with the contents of the request, except the event time
+func duplicateKey(request *core.RadiusPacket) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d|%d",
+		request.GetStringAVP("Acct-Session-Id"),
+		request.GetStringAVP("NAS-IP-Address"),
+		request.GetStringAVP("NAS-Identifier"),
+		request.GetStringAVP("Acct-Status-Type"),
+		request.GetIntAVP("Acct-Session-Time"),
+		octetsWithGigawords(request, "Acct-Input-Octets", "Acct-Input-Gigawords"),
+		octetsWithGigawords(request, "Acct-Output-Octets", "Acct-Output-Gigawords"),
+		request.GetIntAVP("Acct-Input-Packets"),
+		request.GetIntAVP("Acct-Output-Packets"))
+}
+
+// Removes the requests received before the window. Must be called with the lock held
+func (d *DuplicateDetector) expire(now time.Time) {
+	var i int
+	for i = 0; i < len(d.keys); i++ {
+		if fp, found := d.seen[d.keys[i]]; found && now.Sub(fp.received) <= d.window {
+			break
+		}
+		delete(d.seen, d.keys[i])
+	}
+	d.keys = d.keys[i:]
+}
@@ -0,0 +1,64 @@
+package psbahandlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestDuplicateDetector(t *testing.T) {
+
+	detector := NewDuplicateDetector(10)
+	now := time.Now()
+
+	request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Acct-Session-Id", "session-1").
+		Add("Acct-Status-Type", "Interim-Update").
+		Add("Acct-Session-Time", 60).
+		Add("Acct-Input-Octets", 1000)
+
+	if status := detector.Check(request, now); status != duplicateStatusNew {
+		t.Errorf("first request is %s", status)
+	}
+
+	// Retransmission, with increased delay, before and after the first copy is answered
+	retransmission := request.Copy(nil, nil).Add("Acct-Delay-Time", 3)
+	if status := detector.Check(retransmission, now.Add(3*time.Second)); status != duplicateStatusInProcess {
+		t.Errorf("retransmission while processing is %s", status)
+	}
+	detector.Answered(request)
+	if status := detector.Check(retransmission, now.Add(3*time.Second)); status != duplicateStatusAnswered {
+		t.Errorf("retransmission after answer is %s", status)
+	}
+
+	// Different counters
+	if detector.Check(request.Copy(nil, []string{"Acct-Input-Octets"}).Add("Acct-Input-Octets", 2000), now) != duplicateStatusNew {
+		t.Error("request with different counters is duplicate")
+	}
+
+	// Same contents, but a different event
+	if detector.Check(request, now.Add(5*time.Second)) != duplicateStatusNew {
+		t.Error("request with different event time is duplicate")
+	}
+
+	// Out of the window
+	if detector.Check(request, now.Add(20*time.Second)) != duplicateStatusNew {
+		t.Error("request out of the window is duplicate")
+	}
+	if len(detector.seen) != 1 {
+		t.Errorf("requests not expired %d", len(detector.seen))
+	}
+
+	// Not answered
+	detector.Forget(request)
+	if detector.Check(request, now.Add(20*time.Second)) != duplicateStatusNew {
+		t.Error("forgotten request is duplicate")
+	}
+
+	// Disabled
+	if NewDuplicateDetector(0).Check(request, now) != duplicateStatusNew {
+		t.Error("duplicate detected while disabled")
+	}
+}
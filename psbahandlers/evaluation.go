@@ -0,0 +1,85 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Options for the evaluation of an Access-Request without side effects, that is, without proxying,
+// assigning addresses from the local pools or storing the decision trace
+type EvaluationOptions struct {
+	// If not nil, used instead of looking for the client in the database or special users file. The
+	// ClientId must not be zero, or the client is treated as not found
+	Client *ClientPoU
+
+	// If not zero, the time used to check the expiration of the overrides
+	Time time.Time
+}
+
+// Body of the requests to the evaluation endpoint
+type EvaluationRequest struct {
+	// Attributes of the Access-Request, as in [{"User-Name": "user@realm"}, {"NAS-IP-Address": "127.0.0.1"}]
+	Attributes []core.RadiusAVP
+
+	// Hypothetical client
+	Client *ClientPoU
+
+	// Evaluation time
+	Time time.Time
+}
+
+// Body of the responses of the evaluation endpoint
+type EvaluationResponse struct {
+	// 2 for Access-Accept and 3 for Access-Reject. Zero if an error was produced, in which case
+	// no response would be sent to the NAS
+	Code       byte
+	Attributes []core.RadiusAVP
+	Error      string `json:",omitempty"`
+	Trace      *DecisionTrace
+}
+
+// Produces the response that would be sent to the Access-Request, without side effects
+func EvaluateAccessRequest(request *core.RadiusPacket, options EvaluationOptions) (*core.RadiusPacket, *DecisionTrace, error) {
+
+	hl := core.NewHandlerLogger()
+	defer hl.WriteLog()
+
+	ctx := newRequestContext(request, hl)
+	ctx.evaluation = &options
+
+	trace := newDecisionTrace(&ctx)
+	response, err := decideAccess(request, &ctx, trace, hl)
+	trace.complete(response, err)
+
+	return response, trace, err
+}
+
+// Evaluates the Access-Request posted as an EvaluationRequest
+func evaluationAdminHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var evalRequest EvaluationRequest
+	if err := json.NewDecoder(req.Body).Decode(&evalRequest); err != nil {
+		http.Error(w, "bad evaluation request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).AddAVPs(evalRequest.Attributes)
+	response, trace, err := EvaluateAccessRequest(request, EvaluationOptions{Client: evalRequest.Client, Time: evalRequest.Time})
+
+	evalResponse := EvaluationResponse{Trace: trace}
+	if err != nil {
+		evalResponse.Error = err.Error()
+	} else {
+		evalResponse.Code = response.Code
+		evalResponse.Attributes = response.AVPs
+	}
+
+	writeJSONResponse(w, evalResponse)
+}
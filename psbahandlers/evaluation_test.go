@@ -0,0 +1,99 @@
+package psbahandlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluation(t *testing.T) {
+
+	// Hypothetical client with a plan override that expires at the beginning of 2030
+	client := ClientPoU{
+		ClientId:            1,
+		ExternalClientId:    "WhatIf",
+		PlanName:            "Plan1",
+		PlanOverride:        "Plan2",
+		PlanOverrideExpDate: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	evaluate := func(evalTime time.Time) EvaluationResponse {
+		body, _ := json.Marshal(map[string]any{
+			"attributes": []map[string]any{
+				{"User-Name": "whatif@database.provision.nopermissive.doreject.block_addon.proxy"},
+				{"NAS-IP-Address": "127.0.0.1"},
+				{"NAS-Port": 9996},
+			},
+			"client": client,
+			"time":   evalTime,
+		})
+		resp, err := http2Client.Post("https://localhost:9191/evaluate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not post evaluation request: %s", err)
+		}
+		defer resp.Body.Close()
+
+		var evalResponse EvaluationResponse
+		if err := json.NewDecoder(resp.Body).Decode(&evalResponse); err != nil {
+			t.Fatalf("could not parse evaluation response: %s", err)
+		}
+		return evalResponse
+	}
+
+	// Before expiration, the override applies and the proxy is not performed
+	evalResponse := evaluate(time.Date(2029, 12, 31, 23, 0, 0, 0, time.UTC))
+	if evalResponse.Code != 2 || evalResponse.Trace == nil {
+		t.Fatalf("bad evaluation response %v", evalResponse)
+	}
+	if evalResponse.Trace.PlanName != "Plan2" {
+		t.Errorf("plan override not applied %v", evalResponse.Trace)
+	}
+	if !strings.HasPrefix(evalResponse.Trace.ProxyOutcome, "not proxied") {
+		t.Errorf("bad proxy outcome %s", evalResponse.Trace.ProxyOutcome)
+	}
+	var found bool
+	for _, avp := range evalResponse.Attributes {
+		if avp.Name == "Framed-IP-Address" {
+			t.Errorf("attribute from proxy found")
+		}
+		if avp.Name == "HW-Output-Committed-Information-Rate" && avp.GetString() == "2000" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("attributes of overriden plan not found %v", evalResponse.Attributes)
+	}
+
+	// After expiration
+	evalResponse = evaluate(time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC))
+	if evalResponse.Trace == nil || evalResponse.Trace.PlanName != "Plan1" {
+		t.Errorf("plan override applied after expiration %v", evalResponse.Trace)
+	}
+
+	// The notification addon expires first, but is replaced by the addon override, whose expiration
+	// determines the Session-Timeout
+	client.NotificationExpDate = time.Date(2030, 1, 1, 0, 30, 0, 0, time.UTC)
+	client.AddonProfileOverride = "pcautiv"
+	client.AddonProfileOverrideExpDate = time.Date(2030, 1, 1, 2, 0, 0, 0, time.UTC)
+	evalResponse = evaluate(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	var sessionTimeout int64
+	var class string
+	for _, avp := range evalResponse.Attributes {
+		switch avp.Name {
+		case "Session-Timeout":
+			sessionTimeout = avp.GetInt()
+		case "Class":
+			class = avp.GetString()
+		}
+	}
+	if sessionTimeout < 7200 || !strings.Contains(class, "T:addonOverride") {
+		t.Errorf("bad Session-Timeout %d and Class %s with replaced notification", sessionTimeout, class)
+	}
+
+	// Not stored as a decision trace
+	if traces := decisionTraces.Get("whatif@database.provision.nopermissive.doreject.block_addon.proxy", ""); len(traces) != 0 {
+		t.Errorf("evaluation stored as decision trace")
+	}
+}
@@ -0,0 +1,70 @@
+package psbahandlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Maximum number of events kept
+const maxEvents = 1000
+
+// Notable occurrence to be seen by monitoring, such as the reboot of a NAS
+type HandlerEvent struct {
+	Timestamp time.Time
+	Name      string
+	Source    string
+	Text      string
+}
+
+// Most recent events, oldest first
+type handlerEvents struct {
+	sync.Mutex
+	events []HandlerEvent
+}
+
+var events handlerEvents
+
+// Records the event, logs it and counts it with the source as label
+func raiseEvent(name string, source string, format string, args ...interface{}) {
+	event := HandlerEvent{
+		Timestamp: time.Now(),
+		Name:      name,
+		Source:    source,
+		Text:      fmt.Sprintf(format, args...),
+	}
+
+	events.Lock()
+	events.events = append(events.events, event)
+	if len(events.events) > maxEvents {
+		events.events = events.events[len(events.events)-maxEvents:]
+	}
+	events.Unlock()
+
+	incrementCounter(name, source)
+	core.GetLogger().Warnf("event %s from %s: %s", name, source, event.Text)
+}
+
+// Returns a copy of the events with the specified name, or all of them if empty
+func getEvents(name string) []HandlerEvent {
+	events.Lock()
+	defer events.Unlock()
+
+	found := make([]HandlerEvent, 0)
+	for _, event := range events.events {
+		if name == "" || event.Name == name {
+			found = append(found, event)
+		}
+	}
+
+	return found
+}
+
+// Returns the most recent events, oldest first. If the "name" query parameter is specified,
+// only the events with that name are returned
+func eventsAdminHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSONResponse(w, getEvents(req.URL.Query().Get("name")))
+}
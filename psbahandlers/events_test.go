@@ -0,0 +1,24 @@
+package psbahandlers
+
+import (
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+
+	for i := 0; i < maxEvents+1; i++ {
+		raiseEvent("testEvent", "source", "event number %d", i)
+	}
+	raiseEvent("otherEvent", "source", "other")
+
+	testEvents := getEvents("testEvent")
+	if len(testEvents) != maxEvents-1 {
+		t.Errorf("bad number of events %d", len(testEvents))
+	}
+	if testEvents[len(testEvents)-1].Text != "event number 1000" {
+		t.Errorf("last event not kept %v", testEvents[len(testEvents)-1])
+	}
+	if getCounters()["testEvent"]["source"] != maxEvents+1 {
+		t.Errorf("events not counted")
+	}
+}
@@ -2,10 +2,12 @@ package psbahandlers
 
 import (
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/francistor/igor/cdrwriter"
 	"github.com/francistor/igor/core"
@@ -37,6 +39,40 @@ type RequestContext struct {
 	// Attributes merged from realm > client > global
 	radiusAttributes   handler.AVPItems
 	noRadiusAttributes handler.AVPItems
+
+	// Wholesale ISP of the line, if its configuration has been applied
+	isp string
+
+	// Not nil if the request is being evaluated without side effects
+	evaluation *EvaluationOptions
+}
+
+// Identifier of the access line, used to track the leases of local addresses
+func (ctx *RequestContext) accessLine() string {
+	return fmt.Sprintf("%s:%d", ctx.accessId, ctx.accessPort)
+}
+
+// Merges the configuration and reply attributes of the wholesale ISP, which take precedence over
+// those of the realm, so that the lines are treated according to the ISP even if the realm is missing
+// or spoofed. Returns false if the ISP is not configured
+func (ctx *RequestContext) applyISP(isp string, hl *core.HandlerLogger) bool {
+	ispEntry, found := isps.Get()[isp]
+	if !found {
+		return false
+	}
+
+	ctx.isp = isp
+	ctx.config = ctx.config.OverrideWith(ispEntry.ConfigItems, hl)
+	ctx.radiusAttributes = ctx.radiusAttributes.OverrideWith(ispEntry.ReplyItems)
+	ctx.noRadiusAttributes = ctx.noRadiusAttributes.Add(ispEntry.NonOverridableReplyItems)
+
+	if core.IsDebugEnabled() {
+		hl.L.Debugf("isp config: %s", ispEntry.ConfigItems)
+		hl.L.Debugf("isp attributes: %s", ispEntry.ReplyItems)
+		hl.L.Debugf("no-isp attributes: %s", ispEntry.NonOverridableReplyItems)
+	}
+
+	return true
 }
 
 // Handler variables. Populated on initialization
@@ -49,9 +85,17 @@ var dbHandle *sql.DB
 // Configuration files
 var handlerConfig *core.ConfigObject[HandlerConfig]
 var realms *core.ConfigObject[handler.RadiusUserFile]
+var isps *core.ConfigObject[handler.RadiusUserFile]
 var specialUsers *core.ConfigObject[handler.RadiusUserFile]
-var profiles *core.ConfigObject[handler.RadiusUserFile]
-var basicProfiles *core.TemplatedConfigObject[handler.RadiusUserFile, PlanTemplateParams]
+var profiles *ProfilesConfigObject
+var basicProfiles *PlanProfilesConfigObject
+var radiusClientTypes *core.ConfigObject[RadiusClientTypes]
+
+// Encoding of the Class attribute
+var classCodec *ClassCodec
+
+// Local address pools
+var ipam *IPAddressManager
 
 var radiusCheckers handler.RadiusPacketChecks
 var radiusFilters handler.AVPFilters
@@ -59,6 +103,7 @@ var radiusFilters handler.AVPFilters
 // CDR Writers
 var cdrWriters []*cdrwriter.FileCDRWriter
 var cdrWriteCheckers []string
+var cdrWriterConfigs []CDRWriter
 
 // Populates database config
 func InitHandler(ci *core.PolicyConfigurationManager, r *router.RadiusRouter) error {
@@ -121,17 +166,84 @@ func InitHandler(ci *core.PolicyConfigurationManager, r *router.RadiusRouter) er
 		return fmt.Errorf("could not get realm configuration: %w", err)
 	}
 
-	// Service configuration
-	basicProfiles = core.NewTemplatedConfigObject[handler.RadiusUserFile, PlanTemplateParams]("basicProfiles.txt", "planparameters")
+	// Wholesale ISP config
+	isps = core.NewConfigObject[handler.RadiusUserFile]("isps.json")
+	if err = isps.Update(&ci.CM); err != nil {
+		return fmt.Errorf("could not get isp configuration: %w", err)
+	}
+
+	// Vendor specific attributes
+	radiusClientTypes = core.NewConfigObject[RadiusClientTypes]("radiusClientTypes.json")
+	if err = radiusClientTypes.Update(&ci.CM); err != nil {
+		return fmt.Errorf("could not get radius client types: %w", err)
+	}
+	if err = radiusClientTypes.Get().validate(); err != nil {
+		return fmt.Errorf("bad radius client types configuration: %w", err)
+	}
+
+	// Service configuration. Requires the radius client types to validate the generated profiles
+	basicProfiles = NewPlanProfilesConfigObject("basicProfiles.txt", "planparameters", "planParameterTypes.json")
 	if err = basicProfiles.Update(&ci.CM); err != nil {
 		return fmt.Errorf("could not get basic profiles: %w", err)
 	}
 
-	profiles = core.NewConfigObject[handler.RadiusUserFile]("profiles.json")
+	profiles = NewProfilesConfigObject("profiles.json")
 	if err = profiles.Update(&ci.CM); err != nil {
 		return fmt.Errorf("could not get addon profiles: %w", err)
 	}
 
+	// Storage of decision traces. Not updateable
+	decisionTraces = NewDecisionTraceStore(hc.DecisionTracesPerUser, hc.DecisionTracesMaxUsers)
+
+	// Table of active sessions
+	sessionStore = NewSessionStore()
+	if hc.SessionReaperIntervalMultiple > 0 {
+		sessionReaper = NewSessionReaper(hc.SessionReaperCheckSeconds)
+	}
+
+	// Detection of retransmitted accounting requests. Not updateable
+	duplicateDetector = NewDuplicateDetector(hc.DuplicateAccountingWindowSeconds)
+
+	// Billing cycles. Not updateable
+	if hc.BillingTimeZone != "" {
+		if billingLocation, err = time.LoadLocation(hc.BillingTimeZone); err != nil {
+			panic(fmt.Sprintf("bad billing time zone %s: %s", hc.BillingTimeZone, err))
+		}
+	}
+
+	// Accounting in the clients database. Not updateable
+	if hc.DatabaseAccounting {
+		quotaEnforcer = NewQuotaEnforcer()
+		accountingSink = NewAccountingSink(hc.DatabaseAccountingBatchSize, hc.DatabaseAccountingBatchMillis, hc.DatabaseAccountingQueueSize, writeAccountingToDatabase)
+	}
+
+	// Class attribute encoding. Not updateable
+	classCodecConfig := core.NewConfigObject[ClassCodecConfig]("classCodec.json")
+	if err = classCodecConfig.Update(&ci.CM); err != nil {
+		return fmt.Errorf("could not get class codec configuration: %w", err)
+	}
+	if classCodec, err = NewClassCodec(classCodecConfig.Get()); err != nil {
+		return fmt.Errorf("bad class codec configuration: %w", err)
+	}
+
+	// L2TP Network Servers. Not updateable
+	lnsConfig := core.NewConfigObject[LNSConfig]("lnsSets.json")
+	if err = lnsConfig.Update(&ci.CM); err != nil {
+		return fmt.Errorf("could not get lns configuration: %w", err)
+	}
+	if lnsManager, err = NewLNSManager(lnsConfig.Get()); err != nil {
+		return fmt.Errorf("bad lns configuration: %w", err)
+	}
+
+	// Local address pools. Not updateable
+	ipamConfig := core.NewConfigObject[IPAMConfig]("ipPools.json")
+	if err = ipamConfig.Update(&ci.CM); err != nil {
+		return fmt.Errorf("could not get ip pools configuration: %w", err)
+	}
+	if ipam, err = NewIPAddressManager(ipamConfig.Get()); err != nil {
+		return fmt.Errorf("could not create ip address manager: %w", err)
+	}
+
 	// Radius Checks
 	radiusCheckers, err = handler.NewRadiusPacketChecks("radiusCheckers.json", ci)
 	if err != nil {
@@ -157,6 +269,22 @@ func InitHandler(ci *core.PolicyConfigurationManager, r *router.RadiusRouter) er
 		}
 	}
 
+	// Spools for the copy targets. Not updateable
+	copySpools = make(map[string]*Spool)
+	for _, ct := range hc.CopyTargets {
+		if !ct.Spool {
+			continue
+		}
+		if hc.SpoolDirectory == "" {
+			panic(fmt.Sprintf("spool for copy target %s without SpoolDirectory", ct.TargetName))
+		}
+		spool, err := NewSpool(filepath.Join(hc.SpoolDirectory, ct.TargetName), ct, hc.SpoolRetrySeconds)
+		if err != nil {
+			return err
+		}
+		copySpools[ct.TargetName] = spool
+	}
+
 	// Sanity checks for global config
 	if _, found := radiusFilters[hc.AuthProxyFilterIn]; !found {
 		panic(fmt.Sprintf("filter %s not found", hc.AuthProxyFilterIn))
@@ -173,6 +301,54 @@ func InitHandler(ci *core.PolicyConfigurationManager, r *router.RadiusRouter) er
 		}
 	}
 
+	// Sanity checks for local pools and lns sets, in global, realm and isp configuration
+	checkReferences := func(where string, c HandlerConfig) {
+		if c.LNSSet != "" && !lnsManager.HasSet(c.LNSSet) {
+			panic(fmt.Sprintf("lns set %s not found in %s", c.LNSSet, where))
+		}
+		for _, pool := range []struct{ name, poolType string }{{c.LocalIPv4Pool, "ipv4"}, {c.LocalIPv6PrefixPool, "ipv6prefix"}} {
+			if pool.name == "" {
+				continue
+			}
+			if poolType, err := ipam.PoolType(pool.name); err != nil || poolType != pool.poolType {
+				panic(fmt.Sprintf("%s pool %s not found in %s", pool.poolType, pool.name, where))
+			}
+		}
+	}
+	checkReferences("global configuration", hc)
+	for realmName, realmEntry := range realms.Get() {
+		checkReferences("realm "+realmName, hc.OverrideWith(realmEntry.ConfigItems, core.NewHandlerLogger()))
+	}
+	for ispName, ispEntry := range isps.Get() {
+		checkReferences("isp "+ispName, hc.OverrideWith(ispEntry.ConfigItems, core.NewHandlerLogger()))
+	}
+
+	// Sanity checks for vendor specific sections in profiles
+	for profileName, profile := range profiles.Get() {
+		for clientType := range profile.VendorReplyItems {
+			if _, found := radiusClientTypes.Get()[clientType]; !found {
+				panic(fmt.Sprintf("radius client type %s in profile %s not found", clientType, profileName))
+			}
+		}
+		for clientType := range profile.VendorNonOverridableReplyItems {
+			if _, found := radiusClientTypes.Get()[clientType]; !found {
+				panic(fmt.Sprintf("radius client type %s in profile %s not found", clientType, profileName))
+			}
+		}
+	}
+
+	// Sanity checks for the quotas. The usage is only accumulated with database accounting
+	if len(basicProfiles.Quotas()) > 0 && !hc.DatabaseAccounting {
+		panic("quotas configured without database accounting")
+	}
+	for planName, quota := range basicProfiles.Quotas() {
+		for _, threshold := range quota.Thresholds {
+			if _, found := profiles.Get()[threshold.AddonProfile]; threshold.AddonProfile != "" && !found {
+				panic(fmt.Sprintf("addon profile %s in quota of plan %s not found", threshold.AddonProfile, planName))
+			}
+		}
+	}
+
 	////////////////////////////////////////////////////////////////////////
 	// Create CDR writers
 	////////////////////////////////////////////////////////////////////////
@@ -194,6 +370,7 @@ func InitHandler(ci *core.PolicyConfigurationManager, r *router.RadiusRouter) er
 		}
 		cdrWriters = append(cdrWriters, cdrwriter.NewFileCDRWriter(w.Path, w.FileNamePattern, cdrf, w.RotateSeconds))
 		cdrWriteCheckers = append(cdrWriteCheckers, w.CheckerName)
+		cdrWriterConfigs = append(cdrWriterConfigs, w)
 
 		// Sanity check for checker name
 		if _, found := radiusCheckers[w.CheckerName]; !found {
@@ -201,10 +378,51 @@ func InitHandler(ci *core.PolicyConfigurationManager, r *router.RadiusRouter) er
 		}
 	}
 
+	// Sanity checks for isp config
+	for ispName, ispEntry := range isps.Get() {
+		ic := hc.OverrideWith(ispEntry.ConfigItems, core.NewHandlerLogger())
+		for _, filterName := range []string{ic.AuthProxyFilterIn, ic.AuthProxyFilterOut, ic.AcctProxyFilterOut} {
+			if _, found := radiusFilters[filterName]; !found {
+				panic(fmt.Sprintf("filter %s in isp %s not found", filterName, ispName))
+			}
+		}
+		if ic.ProxyGroupName != "" && ic.ProxyGroupName != "none" {
+			if _, found := ci.RadiusServers().ServerGroups[ic.ProxyGroupName]; !found {
+				panic(fmt.Sprintf("proxy group %s in isp %s not found", ic.ProxyGroupName, ispName))
+			}
+		}
+	nextWriter:
+		for _, writerName := range ic.GetCDRWriterNames() {
+			for _, w := range cdrWriterConfigs {
+				if w.Name == writerName {
+					continue nextWriter
+				}
+			}
+			panic(fmt.Sprintf("cdr writer %s in isp %s not found", writerName, ispName))
+		}
+	}
+
+	// Administrative API
+	if err = startAdminServer(ci); err != nil {
+		return fmt.Errorf("could not start admin server: %w", err)
+	}
+
 	return nil
 }
 
 func CloseHandler() {
+	stopAdminServer()
+	if sessionReaper != nil {
+		sessionReaper.Close()
+	}
+	closeSpools()
+	if accountingSink != nil {
+		accountingSink.Close()
+		quotaEnforcer.Close()
+	}
+	if ipam != nil {
+		ipam.Close()
+	}
 	if dbHandle != nil {
 		dbHandle.Close()
 	}
@@ -213,9 +431,6 @@ func CloseHandler() {
 // Main entry point
 func RequestHandler(request *core.RadiusPacket) (*core.RadiusPacket, error) {
 
-	// Get my copy of the configuration
-	var handlerConfig = handlerConfig.Get()
-
 	hl := core.NewHandlerLogger()
 	l := hl.L
 	l.Debug("")
@@ -231,19 +446,51 @@ func RequestHandler(request *core.RadiusPacket) (*core.RadiusPacket, error) {
 		l.Debug(request.String())
 	}
 
-	// Detect client type based on the attributes received
-	var radiusClientType = "DEFAULT"
+	ctx := newRequestContext(request, hl)
+
+	// Call the corresponding handler
+	switch request.Code {
+	case core.ACCESS_REQUEST:
+		return AccessRequestHandler(request, &ctx, hl)
+	case core.ACCOUNTING_REQUEST:
+		// To avoid issues when sending packets in copy mode
+		var wg sync.WaitGroup
+		resp, err := AccountingRequestHandler(request, &ctx, hl, &wg)
+		wg.Wait()
+		return resp, err
+	}
+
+	// If here, the packet was not recognized
+	return nil, fmt.Errorf("unrecognized code %d for radius packet", request.Code)
+}
+
+// Returns the radius client type of the NAS that sent the request, based on the attributes received.
+// Requests with Cisco-AVPair are from CISCO clients, and thus receive only the attributes for that type
+// and the generic ones
+func detectRadiusClientType(request *core.RadiusPacket) string {
 	if len(request.GetAllAVP("Unisphere-PPPoE-Description")) > 0 {
-		radiusClientType = "HUAWEI"
+		return "HUAWEI"
 	} else if len(request.GetAllAVP("Alc-Client-Hardware-Addr")) > 0 {
-		radiusClientType = "ALU"
-	} else if len(request.GetAllAVP("Cico-AVPair")) > 0 {
-		radiusClientType = "CISCO"
+		return "ALU"
+	} else if len(request.GetAllAVP("Cisco-AVPair")) > 0 {
+		return "CISCO"
 	} else if len(request.GetAllAVP("Unishpere-PPPoE-Description")) > 0 {
-		radiusClientType = "MX"
-	} else {
-		radiusClientType = "DEFAULT"
+		return "MX"
 	}
+	return "DEFAULT"
+}
+
+// Normalizes the request data and merges the configuration for the realm and radius client.
+// Adds to the request the attributes with the cooked access identifiers
+func newRequestContext(request *core.RadiusPacket, hl *core.HandlerLogger) RequestContext {
+
+	l := hl.L
+
+	// Get my copy of the configuration
+	var handlerConfig = handlerConfig.Get()
+
+	// Detect client type based on the attributes received
+	var radiusClientType = detectRadiusClientType(request)
 	l.Debugf("radius client type: %s", radiusClientType)
 
 	// Normalize request data
@@ -343,7 +590,7 @@ func RequestHandler(request *core.RadiusPacket) (*core.RadiusPacket, error) {
 	}
 
 	// Build Request context
-	ctx := RequestContext{
+	return RequestContext{
 		accessId:           accessId,
 		accessPort:         accessPort,
 		userName:           userName,
@@ -354,19 +601,4 @@ func RequestHandler(request *core.RadiusPacket) (*core.RadiusPacket, error) {
 		noRadiusAttributes: noRadiusAttributes,
 		config:             requestConfig,
 	}
-
-	// Call the corresponding handler
-	switch request.Code {
-	case core.ACCESS_REQUEST:
-		return AccessRequestHandler(request, &ctx, hl)
-	case core.ACCOUNTING_REQUEST:
-		// To avoid issues when sending packets in copy mode
-		var wg sync.WaitGroup
-		resp, err := AccountingRequestHandler(request, &ctx, hl, &wg)
-		wg.Wait()
-		return resp, err
-	}
-
-	// If here, the packet was not recognized
-	return nil, fmt.Errorf("unrecognized code %d for radius packet", request.Code)
 }
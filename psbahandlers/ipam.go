@@ -0,0 +1,617 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Maximum number of addresses or prefixes in a pool
+const maxPoolSize = 1 << 24
+
+// Definition of a local address pool
+type IPPoolConfig struct {
+	// "ipv4" for Framed-IP-Address or "ipv6prefix" for Delegated-IPv6-Prefix
+	Type string
+
+	// Networks from which the addresses or prefixes are taken, such as 100.64.0.0/22 or 2001:db8:f000::/44
+	Networks []string
+
+	// Length of the prefixes to assign, for ipv6prefix pools
+	PrefixLength int
+
+	// Addresses or prefixes not to be assigned
+	Excluded []string
+}
+
+// Configuration of the local address management
+type IPAMConfig struct {
+	// The key is the pool name, as used in the localIPv4Pool and localIPv6PrefixPool configuration properties
+	// and plan parameters
+	Pools map[string]IPPoolConfig
+
+	// Where the leases are stored, to survive restarts
+	LeaseFile string
+
+	// Time for the Accounting-Start to be received after the Access-Accept
+	UnconfirmedLeaseSeconds int
+
+	// Time for a confirmed lease to be released if no accounting is received. If zero, the lease is kept until
+	// the Accounting-Stop is received
+	LeaseSeconds int
+}
+
+// Assignment of an address or prefix to an access line
+type Lease struct {
+	Pool          string
+	Address       string
+	AccessLine    string
+	UserName      string
+	Confirmed     bool
+	AcctSessionId string
+	Expires       time.Time
+}
+
+// Usage of a pool
+type IPPoolStatus struct {
+	Size   uint64
+	Leased int
+}
+
+// Range of consecutive addresses or prefixes in a pool
+type poolNetwork struct {
+	first *big.Int
+	count uint64
+}
+
+type ipPool struct {
+	name string
+
+	// Number of bits of the address
+	bits int
+
+	// Length of the items of the pool (32 for ipv4 addresses)
+	itemLength int
+
+	networks []poolNetwork
+	size     uint64
+	excluded map[string]bool
+
+	// Items from this position on have not been assigned since the start, except those read from the lease file
+	cursor uint64
+
+	// Positions of the items released, in the order of release, to be assigned when the items never assigned
+	// are exhausted
+	released []uint64
+}
+
+// Builds the pool from the configuration, verifying its consistency
+func newIPPool(name string, pc IPPoolConfig) (*ipPool, error) {
+
+	pool := ipPool{name: name, excluded: make(map[string]bool)}
+
+	switch pc.Type {
+	case "ipv4":
+		pool.bits = 32
+		pool.itemLength = 32
+	case "ipv6prefix":
+		pool.bits = 128
+		pool.itemLength = pc.PrefixLength
+	default:
+		return nil, fmt.Errorf("unknown type %s", pc.Type)
+	}
+
+	for _, network := range pc.Networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits != pool.bits {
+			return nil, fmt.Errorf("%s is not of type %s", network, pc.Type)
+		}
+		if ones > pool.itemLength || pool.itemLength > pool.bits {
+			return nil, fmt.Errorf("bad prefix length %d for network %s", pool.itemLength, network)
+		}
+		if pool.itemLength-ones > 24 {
+			return nil, fmt.Errorf("network %s is too large", network)
+		}
+
+		pn := poolNetwork{
+			first: new(big.Int).SetBytes(ipNet.IP),
+			count: 1 << (pool.itemLength - ones),
+		}
+		// Skip the network and broadcast addresses
+		if pc.Type == "ipv4" && ones < 31 {
+			pn.first.Add(pn.first, big.NewInt(1))
+			pn.count -= 2
+		}
+		pool.networks = append(pool.networks, pn)
+		pool.size += pn.count
+	}
+
+	if pool.size > maxPoolSize {
+		return nil, fmt.Errorf("pool is too large")
+	}
+
+	for _, excluded := range pc.Excluded {
+		pool.excluded[excluded] = true
+	}
+
+	return &pool, nil
+}
+
+// Returns the address or prefix in the specified position
+func (p *ipPool) item(index uint64) string {
+	for _, pn := range p.networks {
+		if index >= pn.count {
+			index -= pn.count
+			continue
+		}
+
+		offset := new(big.Int).Lsh(new(big.Int).SetUint64(index), uint(p.bits-p.itemLength))
+		addrBytes := new(big.Int).Add(pn.first, offset).FillBytes(make([]byte, p.bits/8))
+		if p.bits == 32 {
+			return net.IP(addrBytes).String()
+		}
+		return fmt.Sprintf("%s/%d", net.IP(addrBytes).String(), p.itemLength)
+	}
+
+	return ""
+}
+
+// Whether the address or prefix belongs to the pool
+func (p *ipPool) contains(item string) bool {
+	_, found := p.index(item)
+	return found
+}
+
+// Returns the position of the address or prefix in the pool, or false if it does not belong to the pool
+func (p *ipPool) index(item string) (uint64, bool) {
+	if p.excluded[item] {
+		return 0, false
+	}
+
+	var ip net.IP
+	if p.bits == 32 {
+		ip = net.ParseIP(item).To4()
+	} else if addr, ipNet, err := net.ParseCIDR(item); err == nil {
+		if ones, _ := ipNet.Mask.Size(); ones == p.itemLength && addr.Equal(ipNet.IP) {
+			ip = addr.To16()
+		}
+	}
+	if ip == nil {
+		return 0, false
+	}
+
+	value := new(big.Int).SetBytes(ip)
+	shift := uint(p.bits - p.itemLength)
+	var base uint64
+	for _, pn := range p.networks {
+		offset := new(big.Int).Sub(value, pn.first)
+		if offset.Sign() >= 0 {
+			index := new(big.Int).Rsh(offset, shift)
+			if index.IsUint64() && index.Uint64() < pn.count {
+				return base + index.Uint64(), true
+			}
+		}
+		base += pn.count
+	}
+
+	return 0, false
+}
+
+// Returns an address or prefix not leased, or false if the pool is exhausted. The items never assigned are
+// used first, and then the released ones, in the order of release, so that the time taken does not depend
+// on the size of the pool
+func (p *ipPool) nextFree(leased map[string]*Lease) (string, bool) {
+	if uint64(len(leased)) >= p.size {
+		return "", false
+	}
+
+	for p.cursor < p.size {
+		item := p.item(p.cursor)
+		p.cursor++
+		if _, found := leased[item]; !found && !p.excluded[item] {
+			return item, true
+		}
+	}
+
+	// The released items may have been assigned again when read from the lease file
+	for len(p.released) > 0 {
+		item := p.item(p.released[0])
+		p.released = p.released[1:]
+		if _, found := leased[item]; !found && !p.excluded[item] {
+			return item, true
+		}
+	}
+
+	return "", false
+}
+
+// Makes the address or prefix available for assignment
+func (p *ipPool) release(item string) {
+	if index, found := p.index(item); found && index < p.cursor {
+		p.released = append(p.released, index)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Assigns addresses and prefixes from the local pools, and keeps track of the leases
+type IPAddressManager struct {
+	sync.Mutex
+
+	config IPAMConfig
+	pools  map[string]*ipPool
+
+	// The key is the pool name, and then the address or prefix
+	leases map[string]map[string]*Lease
+
+	// The key is the access line, and then the pool name
+	lineLeases map[string]map[string]*Lease
+
+	// Whether there are modifications not yet saved to the lease file
+	dirty bool
+
+	// Serializes the writes of the lease file, which are done without holding the main lock
+	saveMutex sync.Mutex
+
+	ticker   *time.Ticker
+	doneChan chan struct{}
+}
+
+// Creates the address manager, reading the leases saved in the lease file, if any, and
+// starts the periodic expiration and saving of leases
+func NewIPAddressManager(config IPAMConfig) (*IPAddressManager, error) {
+
+	m := IPAddressManager{
+		config:     config,
+		pools:      make(map[string]*ipPool),
+		leases:     make(map[string]map[string]*Lease),
+		lineLeases: make(map[string]map[string]*Lease),
+		doneChan:   make(chan struct{}),
+	}
+
+	for poolName, pc := range config.Pools {
+		pool, err := newIPPool(poolName, pc)
+		if err != nil {
+			return nil, fmt.Errorf("bad pool %s: %w", poolName, err)
+		}
+		m.pools[poolName] = pool
+		m.leases[poolName] = make(map[string]*Lease)
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	m.ticker = time.NewTicker(1 * time.Second)
+	go m.maintenanceLoop()
+
+	return &m, nil
+}
+
+// Stops the periodic tasks and saves the leases
+func (m *IPAddressManager) Close() {
+	m.ticker.Stop()
+	close(m.doneChan)
+
+	if err := m.save(); err != nil {
+		core.GetLogger().Errorf("could not save leases: %s", err)
+	}
+}
+
+// Returns the type of the pool, or an error if it does not exist
+func (m *IPAddressManager) PoolType(poolName string) (string, error) {
+	if pc, found := m.config.Pools[poolName]; found {
+		return pc.Type, nil
+	}
+	return "", fmt.Errorf("pool %s not found", poolName)
+}
+
+// Assigns an address or prefix from the pool to the access line, reusing the lease that the access line
+// may already have. The lease must be confirmed by an Accounting-Start, or will be released
+func (m *IPAddressManager) Allocate(poolName string, accessLine string, userName string) (string, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	pool, found := m.pools[poolName]
+	if !found {
+		return "", fmt.Errorf("pool %s not found", poolName)
+	}
+
+	if lease, found := m.lineLeases[accessLine][poolName]; found {
+		if !lease.Confirmed {
+			lease.Expires = time.Now().Add(time.Duration(m.config.UnconfirmedLeaseSeconds) * time.Second)
+		}
+		lease.UserName = userName
+		m.dirty = true
+		return lease.Address, nil
+	}
+
+	address, found := pool.nextFree(m.leases[poolName])
+	if !found {
+		return "", fmt.Errorf("pool %s exhausted", poolName)
+	}
+
+	m.addLease(&Lease{
+		Pool:       poolName,
+		Address:    address,
+		AccessLine: accessLine,
+		UserName:   userName,
+		Expires:    time.Now().Add(time.Duration(m.config.UnconfirmedLeaseSeconds) * time.Second),
+	})
+
+	return address, nil
+}
+
+// Marks the lease of the address or prefix as in use, typically after an Accounting-Start or Interim.
+// Returns false if there is no such lease for the access line
+func (m *IPAddressManager) Confirm(accessLine string, address string, acctSessionId string) bool {
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, lease := range m.lineLeases[accessLine] {
+		if lease.Address == address {
+			lease.Confirmed = true
+			lease.AcctSessionId = acctSessionId
+			if m.config.LeaseSeconds > 0 {
+				lease.Expires = time.Now().Add(time.Duration(m.config.LeaseSeconds) * time.Second)
+			} else {
+				lease.Expires = time.Time{}
+			}
+			m.dirty = true
+			return true
+		}
+	}
+
+	return false
+}
+
+// Frees the address or prefix leased to the access line. Returns false if there is no such lease
+func (m *IPAddressManager) Release(accessLine string, address string) bool {
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, lease := range m.lineLeases[accessLine] {
+		if lease.Address == address {
+			m.removeLease(lease)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Frees the address or prefix leased to the access line, unless confirmed by the accounting, typically because
+// the Access-Accept that assigned it was not sent. Returns false if there is no such lease or it is confirmed
+func (m *IPAddressManager) ReleaseUnconfirmed(accessLine string, address string) bool {
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, lease := range m.lineLeases[accessLine] {
+		if lease.Address == address && !lease.Confirmed {
+			m.removeLease(lease)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a copy of the leases, optionally filtered by pool, access line and address
+func (m *IPAddressManager) Leases(poolName string, accessLine string, address string) []Lease {
+
+	m.Lock()
+	defer m.Unlock()
+
+	leases := make([]Lease, 0)
+	for pn, poolLeases := range m.leases {
+		if poolName != "" && pn != poolName {
+			continue
+		}
+		for _, lease := range poolLeases {
+			if (accessLine == "" || lease.AccessLine == accessLine) && (address == "" || lease.Address == address) {
+				leases = append(leases, *lease)
+			}
+		}
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].Pool != leases[j].Pool {
+			return leases[i].Pool < leases[j].Pool
+		}
+		return leases[i].Address < leases[j].Address
+	})
+
+	return leases
+}
+
+// Returns the size and number of leases of each pool
+func (m *IPAddressManager) PoolsStatus() map[string]IPPoolStatus {
+
+	m.Lock()
+	defer m.Unlock()
+
+	status := make(map[string]IPPoolStatus)
+	for poolName, pool := range m.pools {
+		status[poolName] = IPPoolStatus{Size: pool.size, Leased: len(m.leases[poolName])}
+	}
+
+	return status
+}
+
+// Must be called with the lock held
+func (m *IPAddressManager) addLease(lease *Lease) {
+	m.leases[lease.Pool][lease.Address] = lease
+	if m.lineLeases[lease.AccessLine] == nil {
+		m.lineLeases[lease.AccessLine] = make(map[string]*Lease)
+	}
+	m.lineLeases[lease.AccessLine][lease.Pool] = lease
+	m.dirty = true
+}
+
+// Must be called with the lock held
+func (m *IPAddressManager) removeLease(lease *Lease) {
+	m.pools[lease.Pool].release(lease.Address)
+	delete(m.leases[lease.Pool], lease.Address)
+	delete(m.lineLeases[lease.AccessLine], lease.Pool)
+	if len(m.lineLeases[lease.AccessLine]) == 0 {
+		delete(m.lineLeases, lease.AccessLine)
+	}
+	m.dirty = true
+}
+
+// Periodically releases the expired leases and saves the modifications
+func (m *IPAddressManager) maintenanceLoop() {
+	for {
+		select {
+		case <-m.doneChan:
+			return
+		case now := <-m.ticker.C:
+			m.Lock()
+			m.expire(now)
+			dirty := m.dirty
+			m.Unlock()
+			if dirty {
+				if err := m.save(); err != nil {
+					core.GetLogger().Errorf("could not save leases: %s", err)
+				}
+			}
+		}
+	}
+}
+
+// Must be called with the lock held
+func (m *IPAddressManager) expire(now time.Time) {
+	for _, poolLeases := range m.leases {
+		for _, lease := range poolLeases {
+			if !lease.Expires.IsZero() && lease.Expires.Before(now) {
+				core.GetLogger().Infof("lease of %s for %s in pool %s expired", lease.Address, lease.AccessLine, lease.Pool)
+				m.removeLease(lease)
+			}
+		}
+	}
+}
+
+// Writes the leases to the lease file, replacing it atomically. The leases are copied with the lock held and
+// written after releasing it, so that the allocations do not wait for the disk. Must be called without the lock
+func (m *IPAddressManager) save() error {
+	if m.config.LeaseFile == "" {
+		return nil
+	}
+
+	m.saveMutex.Lock()
+	defer m.saveMutex.Unlock()
+
+	m.Lock()
+	leases := make([]Lease, 0)
+	for _, poolLeases := range m.leases {
+		for _, lease := range poolLeases {
+			leases = append(leases, *lease)
+		}
+	}
+	m.dirty = false
+	m.Unlock()
+
+	if err := m.writeLeaseFile(leases); err != nil {
+		// To be retried in the next tick
+		m.Lock()
+		m.dirty = true
+		m.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (m *IPAddressManager) writeLeaseFile(leases []Lease) error {
+	jBytes, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.config.LeaseFile), 0755); err != nil {
+		return err
+	}
+	tmpFile := m.config.LeaseFile + ".tmp"
+	// Holds subscriber data
+	if err := os.WriteFile(tmpFile, jBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, m.config.LeaseFile)
+}
+
+// Reads the leases from the lease file. Leases for pools or addresses no longer configured are discarded
+func (m *IPAddressManager) load() error {
+	if m.config.LeaseFile == "" {
+		return nil
+	}
+
+	jBytes, err := os.ReadFile(m.config.LeaseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read lease file: %w", err)
+	}
+
+	var leases []*Lease
+	if err := json.Unmarshal(jBytes, &leases); err != nil {
+		return fmt.Errorf("could not parse lease file: %w", err)
+	}
+
+	for _, lease := range leases {
+		if pool, found := m.pools[lease.Pool]; !found || !pool.contains(lease.Address) {
+			core.GetLogger().Warnf("discarding lease of %s for %s in pool %s", lease.Address, lease.AccessLine, lease.Pool)
+			continue
+		}
+		m.addLease(lease)
+	}
+
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Confirms the leases of the addresses reported in Accounting-Start and Interim-Update requests,
+// and releases them when the Accounting-Stop is received
+func updateLeases(request *core.RadiusPacket, accessLine string, hl *core.HandlerLogger) {
+
+	l := hl.L
+
+	var addresses []string
+	if address := request.GetStringAVP("Framed-IP-Address"); address != "" {
+		addresses = append(addresses, address)
+	}
+	if prefix := request.GetStringAVP("Delegated-IPv6-Prefix"); prefix != "" {
+		addresses = append(addresses, prefix)
+	}
+
+	statusType := request.GetStringAVP("Acct-Status-Type")
+	for _, address := range addresses {
+		switch statusType {
+		case "Start", "Interim-Update":
+			if ipam.Confirm(accessLine, address, request.GetStringAVP("Acct-Session-Id")) {
+				l.Debugf("lease of %s for %s confirmed", address, accessLine)
+			}
+		case "Stop":
+			if ipam.Release(accessLine, address) {
+				l.Debugf("lease of %s for %s released", address, accessLine)
+			}
+		}
+	}
+}
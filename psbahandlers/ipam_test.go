@@ -0,0 +1,235 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestIPPools(t *testing.T) {
+
+	// Network and broadcast addresses are not assigned
+	v4Pool, err := newIPPool("v4", IPPoolConfig{Type: "ipv4", Networks: []string{"10.0.0.0/30", "10.0.1.0/29"}, Excluded: []string{"10.0.1.1"}})
+	if err != nil {
+		t.Fatalf("could not create ipv4 pool: %s", err)
+	}
+	if v4Pool.size != 8 {
+		t.Errorf("ipv4 pool size is %d", v4Pool.size)
+	}
+	if item := v4Pool.item(0); item != "10.0.0.1" {
+		t.Errorf("first item is %s", item)
+	}
+	if item := v4Pool.item(2); item != "10.0.1.1" {
+		t.Errorf("third item is %s", item)
+	}
+	if !v4Pool.contains("10.0.1.6") || v4Pool.contains("10.0.1.7") || v4Pool.contains("10.0.1.1") {
+		t.Errorf("bad contains for ipv4 pool")
+	}
+
+	// Excluded and leased addresses are skipped
+	leased := map[string]*Lease{"10.0.0.1": {}, "10.0.0.2": {}}
+	if item, _ := v4Pool.nextFree(leased); item != "10.0.1.2" {
+		t.Errorf("next free item is %s", item)
+	}
+
+	// Released items are reused in order of release, after the ones never assigned
+	leased["10.0.1.2"] = &Lease{}
+	for _, item := range []string{"10.0.1.3", "10.0.1.4", "10.0.1.5", "10.0.1.6"} {
+		if next, _ := v4Pool.nextFree(leased); next != item {
+			t.Errorf("next free item is %s, expected %s", next, item)
+		}
+		leased[item] = &Lease{}
+	}
+	for _, item := range []string{"10.0.1.4", "10.0.0.1"} {
+		delete(leased, item)
+		v4Pool.release(item)
+	}
+	if next, _ := v4Pool.nextFree(leased); next != "10.0.1.4" {
+		t.Errorf("next free item after release is %s", next)
+	}
+
+	v6Pool, err := newIPPool("v6", IPPoolConfig{Type: "ipv6prefix", Networks: []string{"2001:db8:f000::/48"}, PrefixLength: 56})
+	if err != nil {
+		t.Fatalf("could not create ipv6 pool: %s", err)
+	}
+	if v6Pool.size != 256 {
+		t.Errorf("ipv6 pool size is %d", v6Pool.size)
+	}
+	if item := v6Pool.item(1); item != "2001:db8:f000:100::/56" {
+		t.Errorf("second prefix is %s", item)
+	}
+	if !v6Pool.contains("2001:db8:f000:ff00::/56") || v6Pool.contains("2001:db8:f001::/56") || v6Pool.contains("2001:db8:f000:100::/64") {
+		t.Errorf("bad contains for ipv6 pool")
+	}
+
+	// Bad configurations
+	for _, pc := range []IPPoolConfig{
+		{Type: "ipv5", Networks: []string{"10.0.0.0/24"}},
+		{Type: "ipv4", Networks: []string{"2001:db8::/64"}},
+		{Type: "ipv6prefix", Networks: []string{"2001:db8::/48"}, PrefixLength: 40},
+		{Type: "ipv6prefix", Networks: []string{"2001:db8::/32"}, PrefixLength: 64},
+	} {
+		if _, err := newIPPool("bad", pc); err == nil {
+			t.Errorf("bad pool configuration not detected %v", pc)
+		}
+	}
+}
+
+func TestIPAddressManager(t *testing.T) {
+
+	config := IPAMConfig{
+		Pools: map[string]IPPoolConfig{
+			"small": {Type: "ipv4", Networks: []string{"10.0.0.0/30"}},
+		},
+		LeaseFile:               filepath.Join(t.TempDir(), "leases.json"),
+		UnconfirmedLeaseSeconds: 60,
+	}
+
+	m, err := NewIPAddressManager(config)
+	if err != nil {
+		t.Fatalf("could not create address manager: %s", err)
+	}
+
+	addr1, err := m.Allocate("small", "line1", "user1")
+	if err != nil {
+		t.Fatalf("could not allocate address: %s", err)
+	}
+	// The same access line gets the same address
+	if addr, _ := m.Allocate("small", "line1", "user1"); addr != addr1 {
+		t.Errorf("address reassigned to %s", addr)
+	}
+	addr2, err := m.Allocate("small", "line2", "user2")
+	if err != nil || addr2 == addr1 {
+		t.Fatalf("could not allocate second address: %s %s", addr2, err)
+	}
+	if _, err := m.Allocate("small", "line3", "user3"); err == nil {
+		t.Errorf("pool exhaustion not detected")
+	}
+	if _, err := m.Allocate("nothere", "line3", "user3"); err == nil {
+		t.Errorf("unknown pool not detected")
+	}
+
+	// Released if the Access-Accept is not sent
+	if !m.ReleaseUnconfirmed("line2", addr2) {
+		t.Errorf("unconfirmed lease not released")
+	}
+	if addr, err := m.Allocate("small", "line2", "user2"); err != nil || addr != addr2 {
+		t.Fatalf("could not allocate released address: %s %s", addr, err)
+	}
+
+	if !m.Confirm("line1", addr1, "session1") {
+		t.Errorf("lease not confirmed")
+	}
+	if m.ReleaseUnconfirmed("line1", addr1) {
+		t.Errorf("confirmed lease released")
+	}
+	if m.Confirm("line2", addr1, "session1") {
+		t.Errorf("confirmed lease for other access line")
+	}
+
+	// Unconfirmed leases expire
+	m.Lock()
+	m.expire(time.Now().Add(2 * time.Minute))
+	m.Unlock()
+	if leases := m.Leases("", "line2", ""); len(leases) != 0 {
+		t.Errorf("lease not expired %v", leases)
+	}
+
+	// Leases survive restarts
+	m.Close()
+	if info, err := os.Stat(config.LeaseFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("bad lease file %v %s", info, err)
+	}
+	m, err = NewIPAddressManager(config)
+	if err != nil {
+		t.Fatalf("could not recreate address manager: %s", err)
+	}
+	defer m.Close()
+
+	leases := m.Leases("small", "", "")
+	if len(leases) != 1 || leases[0].Address != addr1 || !leases[0].Confirmed || leases[0].AcctSessionId != "session1" {
+		t.Errorf("leases after restart are %v", leases)
+	}
+
+	if !m.Release("line1", addr1) {
+		t.Errorf("lease not released")
+	}
+	if status := m.PoolsStatus()["small"]; status.Size != 2 || status.Leased != 0 {
+		t.Errorf("pool status is %v", status)
+	}
+}
+
+func TestLocalPoolsAssignment(t *testing.T) {
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9997).
+		Add("User-Name", "pooled@ipam.file.provision.permissive.noreject.block_basic.noproxy").
+		Add("Igor-OctetsAttribute", "01")
+
+	response, err := clientRouter.RouteRadiusRequest(request, "psba-server-group", 1*time.Second, 1, 1, "")
+	if err != nil {
+		t.Fatalf("could not send access request: %s", err)
+	}
+	address := response.GetStringAVP("Framed-IP-Address")
+	if !strings.HasPrefix(address, "100.64.0.") {
+		t.Fatalf("bad Framed-IP-Address %s", address)
+	}
+	if prefix := response.GetStringAVP("Delegated-IPv6-Prefix"); !strings.HasPrefix(prefix, "2001:db8:f000:") {
+		t.Errorf("bad Delegated-IPv6-Prefix %s", prefix)
+	}
+
+	// Confirm with accounting start
+	acctRequest := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("NAS-Port", 9997).
+		Add("User-Name", "pooled@ipam.file.provision.permissive.noreject.block_basic.noproxy").
+		Add("Acct-Session-Id", "pooled-session").
+		Add("Framed-IP-Address", address)
+	if _, err := clientRouter.RouteRadiusRequest(acctRequest.Copy(nil, nil).Add("Acct-Status-Type", "Start"), "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("could not send accounting start: %s", err)
+	}
+
+	leases := getLeases(t, "127.0.0.1:9997")
+	if len(leases) != 2 {
+		t.Fatalf("leases are %v", leases)
+	}
+	for _, lease := range leases {
+		if lease.Address == address && (!lease.Confirmed || lease.AcctSessionId != "pooled-session") {
+			t.Errorf("lease not confirmed %v", lease)
+		}
+	}
+
+	// Release with accounting stop
+	if _, err := clientRouter.RouteRadiusRequest(acctRequest.Copy(nil, nil).Add("Acct-Status-Type", "Stop"), "psba-server-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("could not send accounting stop: %s", err)
+	}
+	for _, lease := range getLeases(t, "127.0.0.1:9997") {
+		if lease.Address == address {
+			t.Errorf("lease not released %v", lease)
+		}
+	}
+}
+
+// Retrieves the leases of the access line using the administrative API
+func getLeases(t *testing.T, accessLine string) []Lease {
+	resp, err := http2Client.Get("https://localhost:9191/ipam/leases?accessLine=" + accessLine)
+	if err != nil {
+		t.Fatalf("could not get leases: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var leases []Lease
+	if err := json.Unmarshal(body, &leases); err != nil {
+		t.Fatalf("could not parse leases %s: %s", string(body), err)
+	}
+
+	return leases
+}
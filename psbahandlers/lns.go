@@ -0,0 +1,323 @@
+package psbahandlers
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/francistor/igor/core"
+)
+
+// Maximum number of tunnels that may be specified using tags
+const maxTunnelTag = 31
+
+// L2TP Network Server to which the sessions of a realm or ISP are tunneled
+type LNSServer struct {
+	Name string
+
+	// Sent as Tunnel-Server-Endpoint
+	Endpoint string
+
+	// Relative weight for the weighted ordering. Defaults to 1
+	Weight int
+
+	// Sent as Tunnel-Preference for the preference ordering. Lower values are preferred
+	Preference int
+
+	// Override the values for the set
+	PasswordEnvironmentVariable string
+	Password                    string
+	AssignmentId                string
+}
+
+// Group of L2TP Network Servers to which the sessions of a realm or ISP are tunneled
+type LNSSet struct {
+	// "weighted", "random" or "preference". With weighted and random ordering, the Tunnel-Preference
+	// is the position of the LNS in the generated list
+	Ordering string
+
+	// Maximum number of tunnels to send. If zero, all the LNS not drained are sent
+	MaxTunnels int
+
+	// Defaults to L2TP and IPv4
+	TunnelType       string
+	TunnelMediumType string
+
+	// Sent as Tunnel-Password, Tunnel-Client-Endpoint and Tunnel-Client-Auth-Id if not empty
+	Password       string
+	ClientEndpoint string
+	ClientAuthId   string
+
+	// Name of the environment variable holding the Tunnel-Password, so that it is not kept in the
+	// configuration files. Takes precedence over the Password, which is to be used for testing only
+	PasswordEnvironmentVariable string
+
+	// Sent as Tunnel-Assignment-Id if not empty. Defaults to the name of the LNS
+	AssignmentId string
+
+	Servers []LNSServer
+}
+
+// Contents of the LNS configuration file
+type LNSConfig struct {
+	Sets map[string]LNSSet
+}
+
+// Status of an LNS, as reported in the administrative API
+type LNSStatus struct {
+	Name     string
+	Endpoint string
+	Drained  bool
+}
+
+// Builds the tunnel attributes for the LNS sets, keeping track of the LNS that are drained,
+// that is, not assigned to new sessions. The drained status is not persisted
+type LNSManager struct {
+	sync.RWMutex
+
+	sets map[string]LNSSet
+
+	// Indexed by <set>/<server>
+	drained map[string]bool
+}
+
+var lnsManager *LNSManager
+
+// Creates the LNS manager, verifying the configuration
+func NewLNSManager(config LNSConfig) (*LNSManager, error) {
+
+	sets := make(map[string]LNSSet)
+	for setName, set := range config.Sets {
+		switch set.Ordering {
+		case "weighted", "random", "preference":
+		case "":
+			set.Ordering = "weighted"
+		default:
+			return nil, fmt.Errorf("bad ordering %s in lns set %s", set.Ordering, setName)
+		}
+		if set.TunnelType == "" {
+			set.TunnelType = "L2TP"
+		}
+		if set.TunnelMediumType == "" {
+			set.TunnelMediumType = "IPv4"
+		}
+		if len(set.Servers) == 0 || len(set.Servers) > maxTunnelTag {
+			return nil, fmt.Errorf("lns set %s must have between 1 and %d servers", setName, maxTunnelTag)
+		}
+		if strings.Contains(set.ClientEndpoint+set.ClientAuthId+set.AssignmentId, ":") {
+			return nil, fmt.Errorf("tagged values in lns set %s cannot contain colons", setName)
+		}
+		if set.PasswordEnvironmentVariable != "" {
+			if set.Password = os.Getenv(set.PasswordEnvironmentVariable); set.Password == "" {
+				return nil, fmt.Errorf("no password for lns set %s in %s", setName, set.PasswordEnvironmentVariable)
+			}
+		}
+
+		servers := make([]LNSServer, len(set.Servers))
+		names := make(map[string]bool)
+		for i, server := range set.Servers {
+			if server.Name == "" || server.Endpoint == "" || names[server.Name] {
+				return nil, fmt.Errorf("bad or duplicate server name %s in lns set %s", server.Name, setName)
+			}
+			if strings.Contains(server.Name+server.Endpoint+server.AssignmentId, ":") {
+				return nil, fmt.Errorf("tagged values in lns %s cannot contain colons", server.Name)
+			}
+			if server.PasswordEnvironmentVariable != "" {
+				if server.Password = os.Getenv(server.PasswordEnvironmentVariable); server.Password == "" {
+					return nil, fmt.Errorf("no password for lns %s in %s", server.Name, server.PasswordEnvironmentVariable)
+				}
+			}
+			if server.Weight <= 0 {
+				server.Weight = 1
+			}
+			names[server.Name] = true
+			servers[i] = server
+		}
+
+		// The preference ordering is fixed
+		if set.Ordering == "preference" {
+			sort.SliceStable(servers, func(i, j int) bool { return servers[i].Preference < servers[j].Preference })
+		}
+		set.Servers = servers
+
+		sets[setName] = set
+	}
+
+	return &LNSManager{sets: sets, drained: make(map[string]bool)}, nil
+}
+
+// Whether the LNS set exists
+func (m *LNSManager) HasSet(setName string) bool {
+	_, found := m.sets[setName]
+	return found
+}
+
+// Marks the LNS as drained or not
+func (m *LNSManager) Drain(setName string, serverName string, drained bool) error {
+	set, found := m.sets[setName]
+	if !found {
+		return fmt.Errorf("lns set %s not found", setName)
+	}
+	for _, server := range set.Servers {
+		if server.Name == serverName {
+			m.Lock()
+			defer m.Unlock()
+			if drained {
+				m.drained[setName+"/"+serverName] = true
+			} else {
+				delete(m.drained, setName+"/"+serverName)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("lns %s not found in set %s", serverName, setName)
+}
+
+// Returns the status of the LNS in each set
+func (m *LNSManager) Status() map[string][]LNSStatus {
+	m.RLock()
+	defer m.RUnlock()
+
+	status := make(map[string][]LNSStatus)
+	for setName, set := range m.sets {
+		for _, server := range set.Servers {
+			status[setName] = append(status[setName], LNSStatus{
+				Name:     server.Name,
+				Endpoint: server.Endpoint,
+				Drained:  m.drained[setName+"/"+server.Name],
+			})
+		}
+	}
+
+	return status
+}
+
+// Returns the LNS not drained, in the order specified for the set
+func (m *LNSManager) orderedServers(setName string) ([]LNSServer, error) {
+	set, found := m.sets[setName]
+	if !found {
+		return nil, fmt.Errorf("lns set %s not found", setName)
+	}
+
+	m.RLock()
+	available := make([]LNSServer, 0, len(set.Servers))
+	for _, server := range set.Servers {
+		if !m.drained[setName+"/"+server.Name] {
+			available = append(available, server)
+		}
+	}
+	m.RUnlock()
+
+	if len(available) == 0 {
+		return nil, fmt.Errorf("all lns in set %s are drained", setName)
+	}
+
+	switch set.Ordering {
+	case "random":
+		rand.Shuffle(len(available), func(i, j int) { available[i], available[j] = available[j], available[i] })
+	case "weighted":
+		// Pick one at a time, with probability proportional to the weight of the remaining ones
+		for i := range available {
+			var totalWeight int
+			for _, server := range available[i:] {
+				totalWeight += server.Weight
+			}
+			r := rand.Intn(totalWeight)
+			for j := i; j < len(available); j++ {
+				if r < available[j].Weight {
+					available[i], available[j] = available[j], available[i]
+					break
+				}
+				r -= available[j].Weight
+			}
+		}
+	}
+
+	if set.MaxTunnels > 0 && len(available) > set.MaxTunnels {
+		available = available[:set.MaxTunnels]
+	}
+
+	return available, nil
+}
+
+// Generates the tagged tunnel attributes for the LNS set. Each LNS uses a different tag, starting with 1
+func (m *LNSManager) TunnelAttributes(setName string) ([]core.RadiusAVP, error) {
+
+	servers, err := m.orderedServers(setName)
+	if err != nil {
+		return nil, err
+	}
+	set := m.sets[setName]
+
+	type tunnelValue struct{ name, value string }
+
+	var avps []core.RadiusAVP
+	for i, server := range servers {
+		tag := i + 1
+
+		preference := tag
+		if set.Ordering == "preference" {
+			preference = server.Preference
+		}
+		password := set.Password
+		if server.Password != "" {
+			password = server.Password
+		}
+		assignmentId := set.AssignmentId
+		if server.AssignmentId != "" {
+			assignmentId = server.AssignmentId
+		}
+		if assignmentId == "" {
+			assignmentId = server.Name
+		}
+
+		values := []tunnelValue{
+			{"Tunnel-Type", set.TunnelType},
+			{"Tunnel-Medium-Type", set.TunnelMediumType},
+			{"Tunnel-Server-Endpoint", server.Endpoint},
+			{"Tunnel-Assignment-Id", assignmentId},
+			{"Tunnel-Preference", fmt.Sprint(preference)},
+		}
+		if password != "" {
+			values = append(values, tunnelValue{"Tunnel-Password", hex.EncodeToString([]byte(password))})
+		}
+		if set.ClientEndpoint != "" {
+			values = append(values, tunnelValue{"Tunnel-Client-Endpoint", set.ClientEndpoint})
+		}
+		if set.ClientAuthId != "" {
+			values = append(values, tunnelValue{"Tunnel-Client-Auth-Id", set.ClientAuthId})
+		}
+
+		for _, v := range values {
+			avp, err := core.NewRadiusAVP(v.name, fmt.Sprintf("%s:%d", v.value, tag))
+			if err != nil {
+				return nil, fmt.Errorf("could not build %s for lns %s: %w", v.name, server.Name, err)
+			}
+			avps = append(avps, *avp)
+		}
+	}
+
+	return avps, nil
+}
+
+// Returns the status of the LNS. With POST, drains or undrains the LNS specified in the "set" and
+// "server" query parameters, depending on the value of the "drained" parameter
+func lnsAdminHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		query := req.URL.Query()
+		drained := query.Get("drained") != "false"
+		if err := lnsManager.Drain(query.Get("set"), query.Get("server"), drained); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		core.GetLogger().Infof("lns %s in set %s drained: %t", query.Get("server"), query.Get("set"), drained)
+	}
+
+	writeJSONResponse(w, lnsManager.Status())
+}
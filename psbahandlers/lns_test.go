@@ -0,0 +1,123 @@
+package psbahandlers
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestLNSManager(t *testing.T) {
+
+	m, err := NewLNSManager(LNSConfig{Sets: map[string]LNSSet{
+		"weighted": {
+			Ordering:   "weighted",
+			MaxTunnels: 2,
+			Password:   "secret",
+			Servers: []LNSServer{
+				{Name: "lns1", Endpoint: "10.0.0.1", Weight: 100},
+				{Name: "lns2", Endpoint: "10.0.0.2", Weight: 1},
+				{Name: "lns3", Endpoint: "10.0.0.3", Weight: 1},
+			},
+		},
+		"preference": {
+			Ordering: "preference",
+			Servers: []LNSServer{
+				{Name: "backup", Endpoint: "10.0.1.2", Preference: 2},
+				{Name: "primary", Endpoint: "10.0.1.1", Preference: 1},
+			},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("could not create lns manager: %s", err)
+	}
+
+	// Heavier LNS are placed first most of the times
+	var firstCount int
+	for i := 0; i < 100; i++ {
+		servers, _ := m.orderedServers("weighted")
+		if len(servers) != 2 {
+			t.Fatalf("max tunnels not honored: %v", servers)
+		}
+		if servers[0].Name == "lns1" {
+			firstCount++
+		}
+	}
+	if firstCount < 80 {
+		t.Errorf("heavier lns first only %d times", firstCount)
+	}
+
+	// Tagged attributes
+	avps, err := m.TunnelAttributes("preference")
+	if err != nil {
+		t.Fatalf("could not build tunnel attributes: %s", err)
+	}
+	expected := map[string]bool{
+		"Tunnel-Server-Endpoint=10.0.1.1:1": true,
+		"Tunnel-Server-Endpoint=10.0.1.2:2": true,
+		"Tunnel-Preference=1:1":             true,
+		"Tunnel-Preference=2:2":             true,
+		"Tunnel-Type=L2TP:1":                true,
+		"Tunnel-Assignment-Id=backup:2":     true,
+	}
+	for _, avp := range avps {
+		delete(expected, avp.Name+"="+avp.GetTaggedString())
+	}
+	if len(expected) != 0 {
+		t.Errorf("tunnel attributes not found %v in %v", expected, avps)
+	}
+
+	// Drained LNS are not used
+	if err := m.Drain("preference", "primary", true); err != nil {
+		t.Fatalf("could not drain lns: %s", err)
+	}
+	if servers, _ := m.orderedServers("preference"); len(servers) != 1 || servers[0].Name != "backup" {
+		t.Errorf("drained lns used %v", servers)
+	}
+	m.Drain("preference", "backup", true)
+	if _, err := m.TunnelAttributes("preference"); err == nil {
+		t.Errorf("all lns drained not detected")
+	}
+	m.Drain("preference", "primary", false)
+	if status := m.Status()["preference"]; status[0].Drained || !status[1].Drained {
+		t.Errorf("bad lns status %v", status)
+	}
+	if err := m.Drain("preference", "other", true); err == nil {
+		t.Errorf("unknown lns drained")
+	}
+
+	// Password taken from the environment
+	t.Setenv("PSBA_TEST_LNS_PASSWORD", "envsecret")
+	envManager, err := NewLNSManager(LNSConfig{Sets: map[string]LNSSet{
+		"env": {PasswordEnvironmentVariable: "PSBA_TEST_LNS_PASSWORD", Servers: []LNSServer{{Name: "lns1", Endpoint: "10.0.0.1"}}},
+	}})
+	if err != nil {
+		t.Fatalf("could not create lns manager: %s", err)
+	}
+	if avps, _ := envManager.TunnelAttributes("env"); !containsAVP(avps, "Tunnel-Password", hex.EncodeToString([]byte("envsecret"))+":1") {
+		t.Errorf("password from environment not found in %v", avps)
+	}
+
+	// Bad configurations
+	for _, set := range []LNSSet{
+		{PasswordEnvironmentVariable: "PSBA_UNDEFINED_LNS_PASSWORD", Servers: []LNSServer{{Name: "lns1", Endpoint: "10.0.0.1"}}},
+		{Servers: []LNSServer{{Name: "lns1", Endpoint: "10.0.0.1", PasswordEnvironmentVariable: "PSBA_UNDEFINED_LNS_PASSWORD"}}},
+		{Ordering: "roundrobin", Servers: []LNSServer{{Name: "lns1", Endpoint: "10.0.0.1"}}},
+		{Servers: []LNSServer{}},
+		{Servers: []LNSServer{{Name: "lns1", Endpoint: "2001:db8::1"}}},
+		{Servers: []LNSServer{{Name: "lns1", Endpoint: "10.0.0.1"}, {Name: "lns1", Endpoint: "10.0.0.2"}}},
+	} {
+		if _, err := NewLNSManager(LNSConfig{Sets: map[string]LNSSet{"bad": set}}); err == nil {
+			t.Errorf("bad lns set not detected %v", set)
+		}
+	}
+}
+
+func containsAVP(avps []core.RadiusAVP, name string, value string) bool {
+	for _, avp := range avps {
+		if avp.Name == name && avp.GetTaggedString() == value {
+			return true
+		}
+	}
+	return false
+}
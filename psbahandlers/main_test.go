@@ -22,10 +22,26 @@ var superserverRouter *router.RadiusRouter
 
 var http2Client http.Client
 
+// Sent by http2Client in the Authorization header
+const testAdminToken = "test-admin-token"
+
+// Adds the token of the admin server to the requests
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
+
 var testInvoker TestInvoker
 
 var sessionCDRDir = "cdr/session"
 var serviceCDRDir = "cdr/service"
+var wholesaleCDRDir = "cdr/wholesale1"
 
 func TestMain(m *testing.M) {
 
@@ -49,6 +65,18 @@ func TestMain(m *testing.M) {
 	// Clean cdr files
 	os.RemoveAll(sessionCDRDir)
 	os.RemoveAll(serviceCDRDir)
+	os.RemoveAll(wholesaleCDRDir)
+
+	// Token for the admin server, as specified in adminServer.json
+	os.Setenv("PSBA_ADMIN_TOKEN", testAdminToken)
+
+	// Secrets of the keys to sign the Class attribute, as specified in classCodec.json
+	os.Setenv("PSBA_CLASS_KEY_K2", "secret-key-2")
+	os.Setenv("PSBA_CLASS_KEY_K1", "secret-key-1")
+
+	// Tunnel passwords, as specified in lnsSets.json
+	os.Setenv("PSBA_LNS_PASSWORD_WHOLESALE1", "wholesale1-secret")
+	os.Setenv("PSBA_LNS_PASSWORD_LNS3", "lns3-secret")
 
 	// Initialize handler for the server. The superserver will use test Handlers that do not require initialization
 	if err := InitHandler(serverCInstance, serverRouter); err != nil {
@@ -64,8 +92,11 @@ func TestMain(m *testing.M) {
 	// Create an http client with timeout and http2 transport
 	http2Client = http.Client{
 		Timeout: 2 * time.Second,
-		Transport: &http2.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // ignore expired SSL certificates
+		Transport: &bearerTransport{
+			token: testAdminToken,
+			next: &http2.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // ignore expired SSL certificates
+			},
 		},
 	}
 
@@ -30,7 +30,7 @@ type PoU struct {
 	IPv4Address         string
 	IPv6DelegatedPrefix string
 	IPv6WANPrefix       string
-	AccessType          int
+	AccessType          int // 0 for dual stack, 1 for IPv4 only and 2 for IPv6 only. Other values are rejected
 	CheckType           int
 }
 
@@ -38,6 +38,7 @@ type ClientPoU struct {
 	ClientId                    int
 	ExternalClientId            string
 	ISP                         string
+	BillingCycle                int
 	PlanName                    string
 	BlockingStatus              int
 	PlanOverride                string
@@ -53,6 +54,6 @@ type ClientPoU struct {
 	IPv4Address                 string
 	IPv6DelegatedPrefix         string
 	IPv6WANPrefix               string
-	AccessType                  int
+	AccessType                  int // 0 for dual stack, 1 for IPv4 only and 2 for IPv6 only. Other values are rejected
 	CheckType                   int
 }
@@ -0,0 +1,400 @@
+package psbahandlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/francistor/igor/core"
+)
+
+// Parameters of a plan, as read from the planParameters table. The values are json.Number,
+// string, bool or nested objects
+type PlanTemplateParams map[string]any
+
+// Declaration of a plan parameter
+type PlanParameterType struct {
+	// May be "int", "float", "string", "bool" or "object"
+	Type string
+
+	// Whether the parameter must be specified for all plans
+	Required bool
+
+	// Value to use if the parameter is not required and not specified. Numbers must be json.Number, as
+	// when parsed with parseTemplateParams
+	Default any
+}
+
+// The key is the parameter name. Parameters not declared are not checked
+type PlanParameterTypes map[string]PlanParameterType
+
+// Verifies the types of the parameters, and fills the default values for those not specified
+func (pts PlanParameterTypes) check(params PlanTemplateParams) error {
+
+	for paramName, pt := range pts {
+		if _, found := params[paramName]; !found {
+			if pt.Required {
+				return fmt.Errorf("missing required parameter %s", paramName)
+			}
+			if pt.Default != nil {
+				params[paramName] = pt.Default
+			}
+		}
+	}
+
+	return pts.checkTypes(params)
+}
+
+// Verifies the types of the parameters specified. Used also for the per client parameters,
+// which only need to specify the values that are different from those of the plan
+func (pts PlanParameterTypes) checkTypes(params PlanTemplateParams) error {
+
+	for paramName, value := range params {
+		pt, found := pts[paramName]
+		if !found {
+			continue
+		}
+
+		var ok bool
+		switch pt.Type {
+		case "int":
+			if n, isNumber := value.(json.Number); isNumber {
+				_, err := n.Int64()
+				ok = err == nil
+			}
+		case "float":
+			if n, isNumber := value.(json.Number); isNumber {
+				_, err := n.Float64()
+				ok = err == nil
+			}
+		case "string":
+			_, ok = value.(string)
+		case "bool":
+			_, ok = value.(bool)
+		case "object":
+			_, ok = value.(map[string]any)
+		default:
+			return fmt.Errorf("unknown type %s for parameter %s", pt.Type, paramName)
+		}
+
+		if !ok {
+			return fmt.Errorf("parameter %s has value %v, which is not of type %s", paramName, value, pt.Type)
+		}
+	}
+
+	return nil
+}
+
+// Parses a JSON object holding parameters. Numbers are kept as json.Number, to be rendered as they were written
+func parseTemplateParams(jParams []byte, params any) error {
+	decoder := json.NewDecoder(bytes.NewReader(jParams))
+	decoder.UseNumber()
+	return decoder.Decode(params)
+}
+
+// Represents the basic profiles for each plan, generated from a template and the parameters of each plan
+type PlanProfilesConfigObject struct {
+	templateObjectName   string
+	parametersObjectName string
+	typesObjectName      string
+
+	// Replaced as a whole on each update
+	d *planProfilesData
+}
+
+type planProfilesData struct {
+	tmpl       *template.Template
+	paramTypes PlanParameterTypes
+
+	// The key is the plan name. The default values are already filled
+	parametersSet map[string]PlanTemplateParams
+
+	// The key is the plan name
+	profiles map[string]ProfileFile
+
+	// The key is the plan name. Only for the plans with the Quota parameter
+	quotas map[string]*QuotaPolicy
+
+	// Profiles generated for clients with specific parameters. The key is the plan name and the parameters
+	// serialized as JSON. Discarded on each update, together with the rest of the data
+	clientProfilesMutex sync.Mutex
+	clientProfiles      map[string]ProfileFile
+}
+
+// Maximum number of profiles generated for clients with specific parameters to keep. When reached, new ones
+// are generated in each request
+const maxClientProfiles = 10000
+
+// Creates an uninitialized plan profiles configuration object
+func NewPlanProfilesConfigObject(templateObjectName string, parametersObjectName string, typesObjectName string) *PlanProfilesConfigObject {
+	return &PlanProfilesConfigObject{
+		templateObjectName:   templateObjectName,
+		parametersObjectName: parametersObjectName,
+		typesObjectName:      typesObjectName,
+	}
+}
+
+// Reads the template and the parameters, and generates the profiles for each plan. Fails if
+// the parameters of any plan are not of the declared type or if the result is not a valid
+// profile file including the basic profile
+func (po *PlanProfilesConfigObject) Update(cm *core.ConfigurationManager) error {
+
+	// Retrieve the template
+	tmplBytes, err := cm.GetBytesConfigObject(po.templateObjectName)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(po.templateObjectName).Funcs(planTemplateFuncs).Option("missingkey=error").Parse(string(tmplBytes))
+	if err != nil {
+		return fmt.Errorf("could not parse template %s: %w", po.templateObjectName, err)
+	}
+
+	// Retrieve the parameter types. Parsed as the parameters, so that the numeric default values are also
+	// json.Number
+	typesBytes, err := cm.GetBytesConfigObject(po.typesObjectName)
+	if err != nil {
+		return err
+	}
+	var paramTypes PlanParameterTypes
+	if err := parseTemplateParams(typesBytes, &paramTypes); err != nil {
+		return fmt.Errorf("could not parse %s: %w", po.typesObjectName, err)
+	}
+
+	// Retrieve the parameters
+	paramsBytes, err := cm.GetBytesConfigObject(po.parametersObjectName)
+	if err != nil {
+		return err
+	}
+	var parametersSet map[string]PlanTemplateParams
+	if err := parseTemplateParams(paramsBytes, &parametersSet); err != nil {
+		return fmt.Errorf("could not parse %s: %w", po.parametersObjectName, err)
+	}
+
+	// Generate the profiles for each plan
+	theMap := make(map[string]ProfileFile)
+	quotas := make(map[string]*QuotaPolicy)
+	for planName, params := range parametersSet {
+		if params == nil {
+			params = make(PlanTemplateParams)
+			parametersSet[planName] = params
+		}
+		if err := paramTypes.check(params); err != nil {
+			return fmt.Errorf("bad parameters for plan %s: %w", planName, err)
+		}
+		pf, err := renderPlanProfiles(tmpl, params)
+		if err != nil {
+			return fmt.Errorf("bad profile for plan %s: %w", planName, err)
+		}
+		theMap[planName] = pf
+
+		if quotaParam, found := params[quotaParameterName]; found {
+			if quotas[planName], err = parseQuotaPolicy(quotaParam); err != nil {
+				return fmt.Errorf("bad quota for plan %s: %w", planName, err)
+			}
+		}
+	}
+
+	po.d = &planProfilesData{
+		tmpl:          tmpl,
+		paramTypes:    paramTypes,
+		parametersSet: parametersSet,
+		profiles:      theMap,
+		quotas:        quotas,
+	}
+
+	return nil
+}
+
+// Provides access to the profiles of the specified plan
+func (po *PlanProfilesConfigObject) GetKey(planName string) (ProfileFile, error) {
+	if pf, found := po.d.profiles[planName]; found {
+		return pf, nil
+	}
+	return nil, fmt.Errorf("key %s not found", planName)
+}
+
+// Returns the volume quota of the plan, or nil if the plan has none
+func (po *PlanProfilesConfigObject) GetQuota(planName string) *QuotaPolicy {
+	return po.d.quotas[planName]
+}
+
+// Returns the volume quotas of all the plans that have one. The key is the plan name
+func (po *PlanProfilesConfigObject) Quotas() map[string]*QuotaPolicy {
+	return po.d.quotas
+}
+
+// Provides access to the profiles of the specified plan, generated with the parameters of the plan overriden
+// by those specific of the client. If there are no client parameters, the precomputed profiles are returned.
+// The profiles generated are kept, so that the template is executed only once for each plan and parameters
+func (po *PlanProfilesConfigObject) GetKeyForClient(planName string, clientParams PlanTemplateParams) (ProfileFile, error) {
+	d := po.d
+
+	if len(clientParams) == 0 {
+		return po.GetKey(planName)
+	}
+
+	if _, found := d.parametersSet[planName]; !found {
+		return nil, fmt.Errorf("key %s not found", planName)
+	}
+
+	// The keys of the map are serialized in order
+	jParams, err := json.Marshal(clientParams)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := planName + "#" + string(jParams)
+
+	d.clientProfilesMutex.Lock()
+	pf, found := d.clientProfiles[cacheKey]
+	d.clientProfilesMutex.Unlock()
+	if found {
+		return pf, nil
+	}
+
+	if pf, err = renderPlanProfiles(d.tmpl, po.MergedParameters(planName, clientParams)); err != nil {
+		return nil, err
+	}
+
+	d.clientProfilesMutex.Lock()
+	if d.clientProfiles == nil {
+		d.clientProfiles = make(map[string]ProfileFile)
+	}
+	if len(d.clientProfiles) < maxClientProfiles {
+		d.clientProfiles[cacheKey] = pf
+	}
+	d.clientProfilesMutex.Unlock()
+
+	return pf, nil
+}
+
+// Parses the parameters specific of a client, as stored in the database, and verifies their types
+func (po *PlanProfilesConfigObject) ParseClientParameters(jParams string) (PlanTemplateParams, error) {
+	var params PlanTemplateParams
+	if err := parseTemplateParams([]byte(jParams), &params); err != nil {
+		return nil, err
+	}
+	if err := po.d.paramTypes.checkTypes(params); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+// Returns a new map with the parameters of the plan, if found, overriden by the parameters of the client
+func (po *PlanProfilesConfigObject) MergedParameters(planName string, clientParams PlanTemplateParams) PlanTemplateParams {
+	planParams := po.d.parametersSet[planName]
+
+	merged := make(PlanTemplateParams, len(planParams)+len(clientParams))
+	for k, v := range planParams {
+		merged[k] = v
+	}
+	for k, v := range clientParams {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// Executes the template and validates the result, which must include the basic profile and generate valid
+// radius attributes for all the radius client types
+func renderPlanProfiles(tmpl *template.Template, params any) (ProfileFile, error) {
+
+	var tmplRes strings.Builder
+	if err := tmpl.Execute(&tmplRes, params); err != nil {
+		return nil, err
+	}
+
+	var pf ProfileFile
+	if err := json.Unmarshal([]byte(tmplRes.String()), &pf); err != nil {
+		return nil, fmt.Errorf("%w in %s", err, tmplRes.String())
+	}
+
+	basic, found := pf[standardBasicProfileName]
+	if !found {
+		return nil, fmt.Errorf("%s profile not found", standardBasicProfileName)
+	}
+	for clientType := range radiusClientTypes.Get() {
+		if _, _, err := basic.ItemsForClientType(clientType); err != nil {
+			return nil, err
+		}
+	}
+
+	return pf, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Template helper functions
+///////////////////////////////////////////////////////////////////////////////
+
+var planTemplateFuncs = template.FuncMap{
+	"convertRate": convertRate,
+	"convertSize": convertSize,
+	"vendorRate":  vendorRate,
+	"jsonEscape":  jsonEscape,
+}
+
+// Multipliers for rates, in bits per second
+var rateUnits = map[string]float64{
+	"bps":  1,
+	"kbps": 1000,
+	"mbps": 1000 * 1000,
+	"gbps": 1000 * 1000 * 1000,
+}
+
+// Multipliers for sizes, in bytes
+var sizeUnits = map[string]float64{
+	"B":  1,
+	"KB": 1024,
+	"MB": 1024 * 1024,
+	"GB": 1024 * 1024 * 1024,
+}
+
+// Converts the rate from one unit to another, for instance {{convertRate .Speed "mbps" "kbps"}}
+func convertRate(value any, from string, to string) (string, error) {
+	return convertUnits(value, from, to, rateUnits)
+}
+
+// Converts the size from one unit to another, for instance {{convertSize .Burst "KB" "B"}}
+func convertSize(value any, from string, to string) (string, error) {
+	return convertUnits(value, from, to, sizeUnits)
+}
+
+// Converts the rate to the unit used by the specified radius client type, for instance {{vendorRate "HUAWEI" .Speed "kbps"}}
+func vendorRate(clientType string, value any, from string) (string, error) {
+	ct, found := radiusClientTypes.Get()[clientType]
+	if !found || ct.RateUnit == "" {
+		return "", fmt.Errorf("rate unit not defined for radius client type %s", clientType)
+	}
+	return convertRate(value, from, ct.RateUnit)
+}
+
+// Escapes the value to be used inside a JSON string, for instance {"Reply-Message": "{{jsonEscape .Message}}"}
+func jsonEscape(value any) (string, error) {
+	jBytes, err := json.Marshal(fmt.Sprint(value))
+	if err != nil {
+		return "", err
+	}
+	return string(jBytes[1 : len(jBytes)-1]), nil
+}
+
+func convertUnits(value any, from string, to string, units map[string]float64) (string, error) {
+	fromMultiplier, found := units[from]
+	if !found {
+		return "", fmt.Errorf("unknown unit %s", from)
+	}
+	toMultiplier, found := units[to]
+	if !found {
+		return "", fmt.Errorf("unknown unit %s", to)
+	}
+
+	v, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+	if err != nil {
+		return "", fmt.Errorf("%v is not a number", value)
+	}
+
+	return strconv.FormatFloat(v*fromMultiplier/toMultiplier, 'f', -1, 64), nil
+}
@@ -0,0 +1,206 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestPlanParameterTypes(t *testing.T) {
+
+	types := PlanParameterTypes{
+		"Speed":   {Type: "int", Required: true},
+		"Message": {Type: "string", Default: "hello"},
+	}
+
+	params := PlanTemplateParams{"Speed": json.Number("1000")}
+	if err := types.check(params); err != nil {
+		t.Fatalf("parameters not accepted: %s", err)
+	}
+	if params["Message"] != "hello" {
+		t.Errorf("default not applied: %v", params["Message"])
+	}
+
+	if err := types.check(PlanTemplateParams{"Speed": "fast"}); err == nil || !strings.Contains(err.Error(), "Speed") {
+		t.Errorf("bad type not detected: %v", err)
+	}
+	if err := types.check(PlanTemplateParams{"Speed": json.Number("1.5")}); err == nil {
+		t.Errorf("non integer value not detected")
+	}
+	if err := types.check(PlanTemplateParams{"Message": "hello"}); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("missing parameter not detected: %v", err)
+	}
+
+	// Numeric defaults read from the configuration
+	var parsedTypes PlanParameterTypes
+	if err := parseTemplateParams([]byte(`{"Speed": {"type": "int", "default": 0}, "Ratio": {"type": "float", "default": 0.5}}`), &parsedTypes); err != nil {
+		t.Fatalf("could not parse types: %s", err)
+	}
+	params = PlanTemplateParams{}
+	if err := parsedTypes.check(params); err != nil {
+		t.Errorf("numeric defaults not accepted: %s", err)
+	}
+	if params["Speed"] != json.Number("0") || params["Ratio"] != json.Number("0.5") {
+		t.Errorf("numeric defaults not applied: %v", params)
+	}
+}
+
+func TestPlanTemplateFuncs(t *testing.T) {
+
+	tmpl := template.Must(template.New("test").Funcs(planTemplateFuncs).Option("missingkey=error").Parse(
+		`{{convertRate .Speed "mbps" "kbps"}} {{convertSize .Burst "KB" "B"}} {{jsonEscape .Message}}`))
+
+	var sb strings.Builder
+	params := PlanTemplateParams{"Speed": json.Number("10"), "Burst": json.Number("2"), "Message": `say "hi"`}
+	if err := tmpl.Execute(&sb, params); err != nil {
+		t.Fatalf("could not execute template: %s", err)
+	}
+	if sb.String() != `10000 2048 say \"hi\"` {
+		t.Errorf("rendered template is %s", sb.String())
+	}
+
+	if _, err := convertRate(json.Number("10"), "mbps", "furlongs"); err == nil {
+		t.Errorf("bad unit not detected")
+	}
+
+	// Missing parameters are detected
+	if err := tmpl.Execute(&sb, PlanTemplateParams{"Speed": json.Number("10")}); err == nil {
+		t.Errorf("missing parameter not detected")
+	}
+}
+
+func TestPlanProfilesValidation(t *testing.T) {
+
+	// Does not generate a basic profile
+	tmpl := template.Must(template.New("test").Funcs(planTemplateFuncs).Parse(`{"other": {}}`))
+	if _, err := renderPlanProfiles(tmpl, PlanTemplateParams{}); err == nil {
+		t.Errorf("missing basic profile not detected")
+	}
+
+	// Generates an unknown attribute
+	tmpl = template.Must(template.New("test").Funcs(planTemplateFuncs).Parse(`{"basic": {"replyItems": [{"Not-An-Attribute": "{{.Speed}}"}]}}`))
+	if _, err := renderPlanProfiles(tmpl, PlanTemplateParams{"Speed": json.Number("10")}); err == nil {
+		t.Errorf("bad attribute not detected")
+	}
+
+	// Valid profile, with vendor specific rate
+	tmpl = template.Must(template.New("test").Funcs(planTemplateFuncs).Parse(
+		`{"basic": {"replyItems": [{"HW-Input-Committed-Information-Rate": {{vendorRate "HUAWEI" .Speed "kbps"}}}]}}`))
+	pf, err := renderPlanProfiles(tmpl, PlanTemplateParams{"Speed": json.Number("10")})
+	if err != nil {
+		t.Fatalf("could not render profile: %s", err)
+	}
+	if v := findAVPItem(pf["basic"].ReplyItems, "HW-Input-Committed-Information-Rate"); v != "10000" {
+		t.Errorf("rate is %s", v)
+	}
+}
+
+func TestPlanClientParameters(t *testing.T) {
+
+	po := PlanProfilesConfigObject{
+		d: &planProfilesData{
+			tmpl:          template.Must(template.New("test").Funcs(planTemplateFuncs).Parse(`{"basic": {"serviceItems": {"rateLimit": "{{.Speed}}"}}}`)),
+			paramTypes:    PlanParameterTypes{"Speed": {Type: "int", Required: true}, "VRF": {Type: "string"}},
+			parametersSet: map[string]PlanTemplateParams{"Plan1": {"Speed": json.Number("1000"), "Message": "hello"}},
+		},
+	}
+
+	if _, err := po.ParseClientParameters(`{"Speed": "fast"}`); err == nil {
+		t.Errorf("bad client parameter type not detected")
+	}
+	if _, err := po.ParseClientParameters(`not json`); err == nil {
+		t.Errorf("bad client parameters not detected")
+	}
+
+	clientParams, err := po.ParseClientParameters(`{"Speed": 5000, "VRF": "myvrf"}`)
+	if err != nil {
+		t.Fatalf("could not parse client parameters: %s", err)
+	}
+
+	merged := po.MergedParameters("Plan1", clientParams)
+	if merged["Speed"] != json.Number("5000") || merged["Message"] != "hello" || merged["VRF"] != "myvrf" {
+		t.Errorf("merged parameters are %v", merged)
+	}
+	if po.d.parametersSet["Plan1"]["Speed"] != json.Number("1000") {
+		t.Errorf("plan parameters modified")
+	}
+
+	pf, err := po.GetKeyForClient("Plan1", clientParams)
+	if err != nil {
+		t.Fatalf("could not generate profile for client: %s", err)
+	}
+	if pf["basic"].ServiceItems["rateLimit"] != "5000" {
+		t.Errorf("rate limit is %s", pf["basic"].ServiceItems["rateLimit"])
+	}
+
+	if _, err := po.GetKeyForClient("Plan2", clientParams); err == nil {
+		t.Errorf("unknown plan not detected")
+	}
+
+	// Generated only once for the same parameters
+	if len(po.d.clientProfiles) != 1 {
+		t.Errorf("client profiles not kept %v", po.d.clientProfiles)
+	}
+	pf2, _ := po.GetKeyForClient("Plan1", PlanTemplateParams{"VRF": "myvrf", "Speed": json.Number("5000")})
+	if len(po.d.clientProfiles) != 1 || pf2["basic"].ServiceItems["rateLimit"] != "5000" {
+		t.Errorf("client profiles not reused %v", po.d.clientProfiles)
+	}
+}
+
+func TestReplyItemTemplates(t *testing.T) {
+
+	avps := []core.RadiusAVP{}
+	for _, item := range [][2]string{{"Filter-Id", "fixed"}, {"Unisphere-Virtual-Router", "{{.VRF}}"}, {"Reply-Message", "{{.Missing}}"}} {
+		avp, _ := core.NewRadiusAVP(item[0], item[1])
+		avps = append(avps, *avp)
+	}
+
+	rendered := renderReplyItems(avps, PlanTemplateParams{"VRF": "myvrf"}, &RequestVariables{}, core.NewHandlerLogger())
+	if len(rendered) != 2 {
+		t.Fatalf("rendered attributes are %v", rendered)
+	}
+	if v := rendered[1].GetString(); v != "myvrf" {
+		t.Errorf("Unisphere-Virtual-Router is %s", v)
+	}
+	if v := avps[1].GetString(); v != "{{.VRF}}" {
+		t.Errorf("original attribute modified to %s", v)
+	}
+}
+
+func TestRequestVariablesExpansion(t *testing.T) {
+
+	rv := RequestVariables{
+		request:  core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "user@realm"),
+		realm:    "realm",
+		planName: "Plan1",
+		client:   &ClientPoU{ClientId: 1, ExternalClientId: "ext1", Password: "secret"},
+	}
+
+	expanded, err := rv.expand("${User-Name}/${realm}/${plan}/${client.ExternalClientId}/${Calling-Station-Id:-none}")
+	if err != nil {
+		t.Fatalf("could not expand variables: %s", err)
+	}
+	if expanded != "user@realm/realm/Plan1/ext1/none" {
+		t.Errorf("expanded value is %s", expanded)
+	}
+
+	if _, err := rv.expand("${Calling-Station-Id}-${client.NotAField}"); err == nil || !strings.Contains(err.Error(), "Calling-Station-Id,client.NotAField") {
+		t.Errorf("missing variables not reported: %v", err)
+	}
+
+	// Fields not allowed
+	if expanded, _ := rv.expand("${client.Password:-hidden}"); expanded != "hidden" {
+		t.Errorf("password expanded to %s", expanded)
+	}
+
+	// Values from the request that could inject items are not accepted
+	for _, userName := range []string{"user;ip:inacl=permit ip any any", "user=1", "user\x00", "user\nother"} {
+		rv.request = core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", userName)
+		if expanded, err := rv.expand("subscriber:user=${User-Name:-none}"); err == nil {
+			t.Errorf("unsafe value %q expanded to %s", userName, expanded)
+		}
+	}
+}
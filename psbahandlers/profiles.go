@@ -0,0 +1,184 @@
+package psbahandlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/francistor/igor/core"
+	"github.com/francistor/igor/handler"
+)
+
+// Entry in the profiles configuration file. Same as a RadiusUserFileEntry, but may
+// specify a list of base profiles whose items are inherited, with lower priority
+// than the items in the entry itself
+type ProfileEntry struct {
+	handler.RadiusUserFileEntry
+
+	// Base profiles. If more than one, the later ones take precedence
+	Extends []string
+
+	// Vendor neutral items, translated to radius attributes depending on the radius client type. The rates,
+	// such as rateLimit, are in kbps
+	ServiceItems handler.Properties
+
+	// Items to be sent only to the specified radius client type
+	VendorReplyItems               map[string]handler.AVPItems
+	VendorNonOverridableReplyItems map[string]handler.AVPItems
+}
+
+type ProfileFile map[string]ProfileEntry
+
+// Builds the ProfileFile resulting from resolving the inheritance of all the profiles.
+// Returns an error if a profile extends one that does not exist or if a cycle is found
+func (pf ProfileFile) Resolve() (ProfileFile, error) {
+
+	resolved := make(ProfileFile)
+	for name := range pf {
+		if _, err := pf.resolveEntry(name, resolved, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolved, nil
+}
+
+// Resolves the specified profile, storing the result in the resolved map. The path holds the
+// names of the profiles being resolved in the current inheritance chain, to detect cycles
+func (pf ProfileFile) resolveEntry(name string, resolved ProfileFile, path []string) (ProfileEntry, error) {
+
+	if entry, found := resolved[name]; found {
+		return entry, nil
+	}
+
+	for _, p := range path {
+		if p == name {
+			return ProfileEntry{}, fmt.Errorf("cycle in profile inheritance: %s", strings.Join(append(path, name), " -> "))
+		}
+	}
+
+	profile, found := pf[name]
+	if !found {
+		return ProfileEntry{}, fmt.Errorf("profile %s extends unknown profile %s", path[len(path)-1], name)
+	}
+
+	// Full slice expression, so that appends in sibling calls do not share the backing array
+	childPath := append(path[:len(path):len(path)], name)
+
+	var entry ProfileEntry
+	for _, baseName := range profile.Extends {
+		base, err := pf.resolveEntry(baseName, resolved, childPath)
+		if err != nil {
+			return ProfileEntry{}, err
+		}
+		entry = mergeProfileEntries(entry, base)
+	}
+	entry = mergeProfileEntries(entry, profile)
+	entry.Key = name
+
+	resolved[name] = entry
+	return entry, nil
+}
+
+// Merges two entries, the second one with higher priority. The same semantics used when composing
+// the response are applied: ReplyItems are overriden, and NonOverridableReplyItems and OOBReplyItems are added
+func mergeProfileEntries(low ProfileEntry, high ProfileEntry) ProfileEntry {
+	merged := ProfileEntry{
+		RadiusUserFileEntry: handler.RadiusUserFileEntry{
+			CheckItems:               copyProperties(low.CheckItems).OverrideWith(copyProperties(high.CheckItems)),
+			ConfigItems:              copyProperties(low.ConfigItems).OverrideWith(copyProperties(high.ConfigItems)),
+			ReplyItems:               copyAVPItems(low.ReplyItems).OverrideWith(copyAVPItems(high.ReplyItems)),
+			NonOverridableReplyItems: copyAVPItems(low.NonOverridableReplyItems).Add(high.NonOverridableReplyItems),
+			OOBReplyItems:            copyAVPItems(low.OOBReplyItems).Add(high.OOBReplyItems),
+		},
+		ServiceItems:                   copyProperties(low.ServiceItems).OverrideWith(copyProperties(high.ServiceItems)),
+		VendorReplyItems:               make(map[string]handler.AVPItems),
+		VendorNonOverridableReplyItems: make(map[string]handler.AVPItems),
+	}
+
+	for clientType, items := range low.VendorReplyItems {
+		merged.VendorReplyItems[clientType] = copyAVPItems(items)
+	}
+	for clientType, items := range high.VendorReplyItems {
+		merged.VendorReplyItems[clientType] = merged.VendorReplyItems[clientType].OverrideWith(copyAVPItems(items))
+	}
+	for clientType, items := range low.VendorNonOverridableReplyItems {
+		merged.VendorNonOverridableReplyItems[clientType] = copyAVPItems(items)
+	}
+	for clientType, items := range high.VendorNonOverridableReplyItems {
+		merged.VendorNonOverridableReplyItems[clientType] = merged.VendorNonOverridableReplyItems[clientType].Add(items)
+	}
+
+	return merged
+}
+
+// Returns the reply items and non overridable reply items of the profile for the specified radius client type.
+// The generic items are overriden by the ones generated from the service items, and those by the vendor specific ones
+func (pe ProfileEntry) ItemsForClientType(clientType string) (handler.AVPItems, handler.AVPItems, error) {
+
+	serviceReplyItems, serviceNonOverridableReplyItems, err := radiusClientTypes.Get()[clientType].RenderServiceItems(pe.ServiceItems)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not render service items for %s: %w", clientType, err)
+	}
+
+	replyItems := copyAVPItems(pe.ReplyItems).
+		OverrideWith(serviceReplyItems).
+		OverrideWith(copyAVPItems(pe.VendorReplyItems[clientType]))
+	nonOverridableReplyItems := copyAVPItems(pe.NonOverridableReplyItems).
+		Add(serviceNonOverridableReplyItems).
+		Add(pe.VendorNonOverridableReplyItems[clientType])
+
+	return replyItems, nonOverridableReplyItems, nil
+}
+
+// The merge functions in the handler package may modify their arguments. These helpers
+// avoid tampering with the configuration objects
+func copyProperties(p handler.Properties) handler.Properties {
+	c := make(handler.Properties, len(p))
+	for k, v := range p {
+		c[k] = v
+	}
+	return c
+}
+
+func copyAVPItems(items handler.AVPItems) handler.AVPItems {
+	c := make(handler.AVPItems, len(items))
+	copy(c, items)
+	return c
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Holds the profiles configuration object, with the inheritance already resolved
+type ProfilesConfigObject struct {
+	objectName string
+	resolved   *ProfileFile
+}
+
+// Creates an uninitialized profiles configuration object
+func NewProfilesConfigObject(name string) *ProfilesConfigObject {
+	return &ProfilesConfigObject{
+		objectName: name,
+	}
+}
+
+// Reads the configuration and resolves the inheritance. If the reading or the resolution fails,
+// the previous contents are kept
+func (po *ProfilesConfigObject) Update(cm *core.ConfigurationManager) error {
+	co := core.NewConfigObject[ProfileFile](po.objectName)
+	if err := co.Update(cm); err != nil {
+		return err
+	}
+
+	resolved, err := co.Get().Resolve()
+	if err != nil {
+		return err
+	}
+	po.resolved = &resolved
+
+	return nil
+}
+
+// Provides access to the resolved profiles
+func (po *ProfilesConfigObject) Get() ProfileFile {
+	return *po.resolved
+}
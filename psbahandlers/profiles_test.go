@@ -0,0 +1,139 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/francistor/igor/core"
+	"github.com/francistor/igor/handler"
+)
+
+func TestProfileInheritance(t *testing.T) {
+
+	jProfiles := `
+	{
+		"base": {
+			"replyItems": [
+				{"Session-Timeout": 3600},
+				{"Filter-Id": "base"}
+			],
+			"nonOverridableReplyItems": [
+				{"Cisco-AVPair": "base=true"}
+			]
+		},
+		"other": {
+			"replyItems": [
+				{"Idle-Timeout": 600}
+			]
+		},
+		"derived": {
+			"extends": ["base", "other"],
+			"replyItems": [
+				{"Filter-Id": "derived"}
+			],
+			"nonOverridableReplyItems": [
+				{"Cisco-AVPair": "derived=true"}
+			]
+		}
+	}
+	`
+
+	var pf ProfileFile
+	if err := json.Unmarshal([]byte(jProfiles), &pf); err != nil {
+		t.Fatalf("could not parse profiles: %s", err)
+	}
+
+	resolved, err := pf.Resolve()
+	if err != nil {
+		t.Fatalf("could not resolve profiles: %s", err)
+	}
+
+	derived := resolved["derived"]
+	if v := findAVPItem(derived.ReplyItems, "Filter-Id"); v != "derived" {
+		t.Errorf("Filter-Id is %s", v)
+	}
+	if v := findAVPItem(derived.ReplyItems, "Session-Timeout"); v != "3600" {
+		t.Errorf("Session-Timeout is %s", v)
+	}
+	if v := findAVPItem(derived.ReplyItems, "Idle-Timeout"); v != "600" {
+		t.Errorf("Idle-Timeout is %s", v)
+	}
+	if len(derived.NonOverridableReplyItems) != 2 {
+		t.Errorf("non overridable reply items are %v", derived.NonOverridableReplyItems)
+	}
+
+	// The base profiles are not modified
+	if v := findAVPItem(resolved["base"].ReplyItems, "Filter-Id"); v != "base" {
+		t.Errorf("Filter-Id in base is %s", v)
+	}
+	if len(resolved["base"].NonOverridableReplyItems) != 1 {
+		t.Errorf("non overridable reply items in base are %v", resolved["base"].NonOverridableReplyItems)
+	}
+}
+
+func TestProfileInheritanceErrors(t *testing.T) {
+
+	cyclic := ProfileFile{
+		"a": ProfileEntry{Extends: []string{"b"}},
+		"b": ProfileEntry{Extends: []string{"c"}},
+		"c": ProfileEntry{Extends: []string{"a"}},
+	}
+	if _, err := cyclic.Resolve(); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cycle not detected: %v", err)
+	}
+
+	unknown := ProfileFile{
+		"a": ProfileEntry{Extends: []string{"nothere"}},
+	}
+	if _, err := unknown.Resolve(); err == nil || !strings.Contains(err.Error(), "nothere") {
+		t.Errorf("unknown base profile not detected: %v", err)
+	}
+}
+
+func TestProfilesUpdateError(t *testing.T) {
+
+	// The contents are kept if the new configuration cannot be resolved
+	po := NewProfilesConfigObject("cyclicProfiles.json")
+	po.resolved = &ProfileFile{"previous": ProfileEntry{}}
+	if err := po.Update(&core.GetPolicyConfigInstance("serverpsba").CM); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cycle not detected: %v", err)
+	}
+	if _, found := po.Get()["previous"]; !found || len(po.Get()) != 1 {
+		t.Errorf("previous profiles not kept %v", po.Get())
+	}
+}
+
+func TestProfilesDump(t *testing.T) {
+
+	resp, err := http2Client.Get("https://localhost:9191/profiles?name=permissive")
+	if err != nil {
+		t.Fatalf("could not get profile: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var profile handler.RadiusUserFileEntry
+	if err := json.Unmarshal(body, &profile); err != nil {
+		t.Fatalf("could not parse profile %s: %s", string(body), err)
+	}
+
+	// Inherited from the "restricted" profile
+	if v := findAVPItem(profile.ReplyItems, "Session-Timeout"); v != "2400" {
+		t.Errorf("Session-Timeout is %s", v)
+	}
+	if v := findAVPItem(profile.ReplyItems, "Unisphere-Service-Bundle"); v != "Apermissive" {
+		t.Errorf("Unisphere-Service-Bundle is %s", v)
+	}
+}
+
+// Returns the value of the first item with the specified name, as a string
+func findAVPItem(items handler.AVPItems, name string) string {
+	for i := range items {
+		if items[i].Name == name {
+			return items[i].GetString()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,258 @@
+package psbahandlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Volume quota of a plan, specified in the Quota plan parameter. For instance
+//
+//	"Quota": {"volumeMB": 100000, "thresholds": [
+//		{"percent": 80, "notify": true},
+//		{"percent": 100, "addonProfile": "throttled", "coa": true, "notify": true}
+//	]}
+//
+// The usage is the sum of the input and output octets of all the sessions of the client during its billing cycle,
+// accumulated by the database accounting sink, which must be enabled, in the table
+//
+//	create table cycleusage (
+//		ExternalClientId varchar(64) not null,
+//		CycleStart datetime not null,
+//		SessionTime bigint,
+//		InputOctets bigint unsigned,
+//		OutputOctets bigint unsigned,
+//		QuotaLevel int,
+//		primary key (ExternalClientId, CycleStart)
+//	);
+//
+// The quota is always that of the plan. Client parameters do not override it, since the accounting carries only
+// the plan name
+type QuotaPolicy struct {
+	VolumeMB int64
+
+	// Ordered by percent
+	Thresholds []QuotaThreshold
+}
+
+// Actions to take when the usage reaches the specified percent of the quota
+type QuotaThreshold struct {
+	Percent int
+
+	// Assigned as addon in the Access-Requests while the usage is above the threshold
+	AddonProfile string
+
+	// If true, a CoA with the attributes of the addon profile is sent to the active sessions of the client when
+	// the threshold is crossed
+	CoA bool
+
+	// If true, a quotaThreshold event is raised when the threshold is crossed
+	Notify bool
+}
+
+const quotaParameterName = "Quota"
+
+// Builds the quota policy from the value of the plan parameter
+func parseQuotaPolicy(value any) (*QuotaPolicy, error) {
+	jBytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy QuotaPolicy
+	decoder := json.NewDecoder(bytes.NewReader(jBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, err
+	}
+
+	if policy.VolumeMB <= 0 {
+		return nil, fmt.Errorf("volumeMB must be positive")
+	}
+	for _, threshold := range policy.Thresholds {
+		if threshold.Percent <= 0 {
+			return nil, fmt.Errorf("percent must be positive")
+		}
+		if threshold.CoA && threshold.AddonProfile == "" {
+			return nil, fmt.Errorf("coa without addonProfile at %d%%", threshold.Percent)
+		}
+	}
+	sort.SliceStable(policy.Thresholds, func(i, j int) bool { return policy.Thresholds[i].Percent < policy.Thresholds[j].Percent })
+
+	return &policy, nil
+}
+
+// Returns the number of thresholds reached with the specified usage, in octets
+func (q *QuotaPolicy) level(usage uint64) int {
+	volume := uint64(q.VolumeMB) * uint64(sizeUnits["MB"])
+	level := 0
+	for _, threshold := range q.Thresholds {
+		if usage*100 < uint64(threshold.Percent)*volume {
+			break
+		}
+		level++
+	}
+	return level
+}
+
+// Returns the percentage of the quota used, rounded down
+func (q *QuotaPolicy) percent(usage uint64) int {
+	return int(usage * 100 / (uint64(q.VolumeMB) * uint64(sizeUnits["MB"])))
+}
+
+// Returns the highest threshold reached, among the first level ones, that specifies an addon profile
+func (q *QuotaPolicy) addonThreshold(level int) (QuotaThreshold, bool) {
+	for i := level - 1; i >= 0; i-- {
+		if q.Thresholds[i].AddonProfile != "" {
+			return q.Thresholds[i], true
+		}
+	}
+	return QuotaThreshold{}, false
+}
+
+// A threshold crossed by the usage of a client
+type quotaCrossing struct {
+	externalClientId string
+	planName         string
+	threshold        QuotaThreshold
+	usage            uint64
+}
+
+// Adds the increments to the usage of the client in the billing cycle that includes the time of the event, and
+// returns the thresholds of the quota of the plan crossed for the first time in the cycle. Since each cycle has
+// its own row, the usage and the thresholds crossed start from zero in a new cycle. Executed in the transaction
+// of the accounting sink
+func updateCycleUsage(tx *sql.Tx, r acctSinkRecord, sessionTime int64, inputOctets uint64, outputOctets uint64) ([]quotaCrossing, error) {
+	day, _, err := clientBillingInfo(tx, r.externalClientId, r.userName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get billing cycle of %s: %w", r.externalClientId, err)
+	}
+	cycleStart, _ := billingCycle(r.eventTime, day)
+
+	if _, err := tx.Exec(`insert into cycleusage
+		(ExternalClientId, CycleStart, SessionTime, InputOctets, OutputOctets, QuotaLevel)
+		values (?, ?, ?, ?, ?, 0)
+		on duplicate key update
+		SessionTime = SessionTime + values(SessionTime),
+		InputOctets = InputOctets + values(InputOctets), OutputOctets = OutputOctets + values(OutputOctets)`,
+		r.externalClientId, cycleStart, sessionTime, inputOctets, outputOctets); err != nil {
+		return nil, fmt.Errorf("could not write cycle usage of %s: %w", r.externalClientId, err)
+	}
+
+	policy := basicProfiles.GetQuota(r.planName)
+	if policy == nil {
+		return nil, nil
+	}
+
+	var usage uint64
+	var previousLevel int
+	if err := tx.QueryRow("select InputOctets + OutputOctets, QuotaLevel from cycleusage where ExternalClientId = ? and CycleStart = ? for update",
+		r.externalClientId, cycleStart).Scan(&usage, &previousLevel); err != nil {
+		return nil, fmt.Errorf("could not read cycle usage of %s: %w", r.externalClientId, err)
+	}
+
+	level := policy.level(usage)
+	if level <= previousLevel {
+		return nil, nil
+	}
+	if _, err := tx.Exec("update cycleusage set QuotaLevel = ? where ExternalClientId = ? and CycleStart = ?",
+		level, r.externalClientId, cycleStart); err != nil {
+		return nil, fmt.Errorf("could not write quota level of %s: %w", r.externalClientId, err)
+	}
+
+	crossings := make([]quotaCrossing, 0, level-previousLevel)
+	for _, threshold := range policy.Thresholds[previousLevel:level] {
+		crossings = append(crossings, quotaCrossing{externalClientId: r.externalClientId, planName: r.planName, threshold: threshold, usage: usage})
+	}
+	return crossings, nil
+}
+
+// Executes the actions of the quota thresholds crossed in its own goroutine, so that the CoAs sent to the NAS
+// do not delay the writing of the accounting
+type QuotaEnforcer struct {
+	crossings chan []quotaCrossing
+	doneChan  chan struct{}
+}
+
+var quotaEnforcer *QuotaEnforcer
+
+// Maximum number of batches of crossings waiting to be executed
+const quotaEnforcerQueueSize = 1000
+
+// Creates the enforcer and starts the execution of the actions
+func NewQuotaEnforcer() *QuotaEnforcer {
+	e := QuotaEnforcer{
+		crossings: make(chan []quotaCrossing, quotaEnforcerQueueSize),
+		doneChan:  make(chan struct{}),
+	}
+	go e.loop()
+
+	return &e
+}
+
+// Queues the crossings. If the queue is full, the actions are not executed, but the addon profile is still
+// applied in the next Access-Request
+func (e *QuotaEnforcer) Add(crossings []quotaCrossing) {
+	if len(crossings) == 0 {
+		return
+	}
+
+	select {
+	case e.crossings <- crossings:
+	default:
+		for _, crossing := range crossings {
+			raiseEvent("quotaError", crossing.externalClientId, "actions of %d%% threshold discarded", crossing.threshold.Percent)
+		}
+	}
+}
+
+// Executes the actions still queued and stops the enforcer
+func (e *QuotaEnforcer) Close() {
+	close(e.crossings)
+	<-e.doneChan
+}
+
+func (e *QuotaEnforcer) loop() {
+	defer close(e.doneChan)
+
+	for crossings := range e.crossings {
+		applyQuotaCrossings(crossings)
+	}
+}
+
+// Executes the actions of the thresholds crossed. The addon profile is applied in the next Access-Request, and
+// to the active sessions if CoA is specified
+func applyQuotaCrossings(crossings []quotaCrossing) {
+	for _, crossing := range crossings {
+		threshold := crossing.threshold
+		incrementCounter("quotaThreshold", fmt.Sprintf("%d", threshold.Percent))
+
+		if threshold.Notify {
+			raiseEvent("quotaThreshold", crossing.externalClientId, "%d%% of the quota of plan %s reached, with %d octets",
+				threshold.Percent, crossing.planName, crossing.usage)
+		}
+
+		if !threshold.CoA {
+			continue
+		}
+		addon, found := profiles.Get()[threshold.AddonProfile]
+		if !found {
+			raiseEvent("quotaError", crossing.externalClientId, "addon profile %s not found", threshold.AddonProfile)
+			continue
+		}
+		sessions, _ := sessionStore.Find("clientId", crossing.externalClientId, 0, 0)
+		for _, session := range sessions {
+			radiusAttrs, noRadiusAttrs, err := addon.ItemsForClientType(session.RadiusClientType)
+			if err != nil {
+				raiseEvent("quotaError", crossing.externalClientId, "could not get attributes of %s: %s", threshold.AddonProfile, err)
+				continue
+			}
+			avps := radiusClientTypes.Get().FilterForeignAttributes(session.RadiusClientType, append(radiusAttrs, noRadiusAttrs...))
+			if err := ChangeSessionAuthorization(session.AcctSessionId, session.nas(), avps); err != nil {
+				raiseEvent("quotaError", crossing.externalClientId, "could not apply %s to session %s: %s", threshold.AddonProfile, session.key(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestQuotaPolicy(t *testing.T) {
+
+	var param map[string]any
+	if err := parseTemplateParams([]byte(`{"volumeMB": 1000, "thresholds": [
+		{"percent": 100, "addonProfile": "throttled", "coa": true},
+		{"percent": 80, "notify": true}
+	]}`), &param); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := parseQuotaPolicy(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Thresholds[0].Percent != 80 {
+		t.Errorf("thresholds not sorted %v", policy.Thresholds)
+	}
+
+	mb := uint64(1024 * 1024)
+	for _, c := range []struct {
+		usage uint64
+		level int
+	}{{0, 0}, {799 * mb, 0}, {800 * mb, 1}, {999 * mb, 1}, {1000 * mb, 2}, {5000 * mb, 2}} {
+		if level := policy.level(c.usage); level != c.level {
+			t.Errorf("level for %d is %d, expected %d", c.usage, level, c.level)
+		}
+	}
+
+	if _, found := policy.addonThreshold(1); found {
+		t.Error("addon before reaching the threshold")
+	}
+	if threshold, found := policy.addonThreshold(2); !found || threshold.AddonProfile != "throttled" {
+		t.Errorf("bad addon threshold %v", threshold)
+	}
+
+	// Bad policies
+	for _, bad := range []map[string]any{
+		{"volumeMB": json.Number("0")},
+		{"volumeMB": json.Number("10"), "thresholds": []any{map[string]any{"percent": json.Number("50"), "coa": true}}},
+		{"volumeMB": json.Number("10"), "unknown": true},
+	} {
+		if _, err := parseQuotaPolicy(bad); err == nil {
+			t.Errorf("bad policy accepted %v", bad)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package psbahandlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/francistor/igor/core"
+	"github.com/francistor/igor/handler"
+)
+
+// Translation of a vendor neutral service item into a radius attribute
+type ServiceAttribute struct {
+	// Name of the radius attribute
+	Name string
+
+	// Format of the value, with a %s verb that is replaced by the value of the service item
+	Format string
+
+	// Whether to send the attribute as a non overridable reply item
+	NonOverridable bool
+}
+
+// Definition of the attributes to send to a radius client type, such as HUAWEI or CISCO
+type RadiusClientType struct {
+	// Prefixes of the names of the attributes that are specific of this client type.
+	// Attributes with prefixes of other client types are not sent
+	AttributePrefixes []string
+
+	// Translation of the service items, such as rateLimit, serviceBundle or vrf
+	ServiceAttributes map[string][]ServiceAttribute
+
+	// Unit of the rate attributes (bps, kbps, mbps or gbps), used by the vendorRate template function and
+	// to convert the rate service items
+	RateUnit string
+
+	// Attributes of the accounting requests that are copied to the Disconnect-Request and CoA-Request to
+	// identify the session in the NAS. Defaults to Acct-Session-Id and NAS-IP-Address
+	SessionIdentifiers []string
+}
+
+// The key is the radius client type name, as detected by the handler
+type RadiusClientTypes map[string]RadiusClientType
+
+// Service items whose values are rates. They are specified in serviceItemRateUnit, and converted to the rate unit
+// of the client type, if defined
+var rateServiceItems = map[string]bool{"rateLimit": true}
+
+const serviceItemRateUnit = "kbps"
+
+// Generates the reply items and non overridable reply items corresponding to the specified vendor neutral
+// service items. Service items that are not defined for this client type are ignored
+func (ct RadiusClientType) RenderServiceItems(serviceItems handler.Properties) (handler.AVPItems, handler.AVPItems, error) {
+
+	var replyItems handler.AVPItems
+	var nonOverridableReplyItems handler.AVPItems
+
+	for itemName, itemValue := range serviceItems {
+		if rateServiceItems[itemName] && ct.RateUnit != "" && len(ct.ServiceAttributes[itemName]) > 0 {
+			rate, err := convertRate(itemValue, serviceItemRateUnit, ct.RateUnit)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not render service item %s with value %s: %w", itemName, itemValue, err)
+			}
+			itemValue = rate
+		}
+		for _, sa := range ct.ServiceAttributes[itemName] {
+			avp, err := core.NewRadiusAVP(sa.Name, fmt.Sprintf(sa.Format, itemValue))
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not render service item %s with value %s: %w", itemName, itemValue, err)
+			}
+			if sa.NonOverridable {
+				nonOverridableReplyItems = append(nonOverridableReplyItems, *avp)
+			} else {
+				replyItems = append(replyItems, *avp)
+			}
+		}
+	}
+
+	return replyItems, nonOverridableReplyItems, nil
+}
+
+// Returns the attributes that may be sent to the specified client type, that is, removes those
+// that are specific of other client types. If the client type does not declare attribute prefixes,
+// the attributes are returned unmodified
+func (cts RadiusClientTypes) FilterForeignAttributes(clientType string, avps []core.RadiusAVP) []core.RadiusAVP {
+
+	if len(cts[clientType].AttributePrefixes) == 0 {
+		return avps
+	}
+
+	filtered := make([]core.RadiusAVP, 0, len(avps))
+	for i := range avps {
+		if !cts.isForeignAttribute(clientType, avps[i].Name) {
+			filtered = append(filtered, avps[i])
+		}
+	}
+
+	return filtered
+}
+
+// Whether the attribute name has the prefix of a client type other than the one specified
+func (cts RadiusClientTypes) isForeignAttribute(clientType string, attrName string) bool {
+
+	if hasAnyPrefix(attrName, cts[clientType].AttributePrefixes) {
+		return false
+	}
+
+	for name, ct := range cts {
+		if name != clientType && hasAnyPrefix(attrName, ct.AttributePrefixes) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sanity check. Verifies that the attributes exist in the dictionary
+func (cts RadiusClientTypes) validate() error {
+	for clientTypeName, ct := range cts {
+		if _, found := rateUnits[ct.RateUnit]; ct.RateUnit != "" && !found {
+			return fmt.Errorf("unknown rate unit %s in client type %s", ct.RateUnit, clientTypeName)
+		}
+		for itemName, serviceAttributes := range ct.ServiceAttributes {
+			for _, sa := range serviceAttributes {
+				if _, err := core.GetRDict().GetFromName(sa.Name); err != nil {
+					return fmt.Errorf("attribute %s for service item %s in client type %s not found in dictionary", sa.Name, itemName, clientTypeName)
+				}
+			}
+		}
+		for _, attrName := range ct.SessionIdentifiers {
+			if _, err := core.GetRDict().GetFromName(attrName); err != nil {
+				return fmt.Errorf("session identifier %s in client type %s not found in dictionary", attrName, clientTypeName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Helper to check the prefix of an attribute name
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package psbahandlers
+
+import (
+	"testing"
+
+	"github.com/francistor/igor/core"
+	"github.com/francistor/igor/handler"
+)
+
+func TestRadiusClientTypes(t *testing.T) {
+
+	cts := RadiusClientTypes{
+		"HUAWEI": RadiusClientType{
+			AttributePrefixes: []string{"HW-"},
+			RateUnit:          "bps",
+			ServiceAttributes: map[string][]ServiceAttribute{
+				"rateLimit": {
+					{Name: "HW-Input-Committed-Information-Rate", Format: "%s"},
+				},
+			},
+		},
+		"CISCO": RadiusClientType{
+			AttributePrefixes: []string{"Cisco-"},
+			RateUnit:          "kbps",
+			ServiceAttributes: map[string][]ServiceAttribute{
+				"rateLimit": {
+					{Name: "Cisco-AVPair", Format: "subscriber:sa=internet(shape-rate=%s)", NonOverridable: true},
+				},
+			},
+		},
+		"DEFAULT": RadiusClientType{},
+	}
+
+	// Rendering
+	replyItems, nonOverridableReplyItems, err := cts["CISCO"].RenderServiceItems(handler.Properties{"rateLimit": "2000", "vrf": "myvrf"})
+	if err != nil {
+		t.Fatalf("could not render service items: %s", err)
+	}
+	if len(replyItems) != 0 {
+		t.Errorf("unexpected reply items %v", replyItems)
+	}
+	if v := findAVPItem(nonOverridableReplyItems, "Cisco-AVPair"); v != "subscriber:sa=internet(shape-rate=2000)" {
+		t.Errorf("Cisco-AVPair is %s", v)
+	}
+
+	// The rate, in kbps, is converted to the unit of the client type
+	replyItems, _, err = cts["HUAWEI"].RenderServiceItems(handler.Properties{"rateLimit": "2000"})
+	if err != nil {
+		t.Fatalf("could not render service items: %s", err)
+	}
+	if v := findAVPItem(replyItems, "HW-Input-Committed-Information-Rate"); v != "2000000" {
+		t.Errorf("HW-Input-Committed-Information-Rate is %s", v)
+	}
+
+	if _, _, err := cts["HUAWEI"].RenderServiceItems(handler.Properties{"rateLimit": "fast"}); err == nil {
+		t.Errorf("bad integer value was rendered")
+	}
+
+	// Filtering
+	var avps []core.RadiusAVP
+	for _, nv := range [][2]string{{"HW-Account-Info", "A"}, {"Cisco-AVPair", "a=b"}, {"Filter-Id", "f"}} {
+		avp, _ := core.NewRadiusAVP(nv[0], nv[1])
+		avps = append(avps, *avp)
+	}
+
+	if filtered := cts.FilterForeignAttributes("HUAWEI", avps); len(filtered) != 2 || findAVPItem(filtered, "Cisco-AVPair") != "" {
+		t.Errorf("bad filtering for HUAWEI %v", filtered)
+	}
+	if filtered := cts.FilterForeignAttributes("DEFAULT", avps); len(filtered) != 3 {
+		t.Errorf("bad filtering for DEFAULT %v", filtered)
+	}
+}
+
+func TestDetectRadiusClientType(t *testing.T) {
+
+	for _, c := range []struct {
+		attrName   string
+		attrValue  string
+		clientType string
+	}{
+		{"Unisphere-PPPoE-Description", "pppoe 00:00:00:00:00:01", "HUAWEI"},
+		{"Alc-Client-Hardware-Addr", "00:00:00:00:00:01", "ALU"},
+		{"Cisco-AVPair", "client-mac-address=0000.0000.0001", "CISCO"},
+		{"Filter-Id", "filter", "DEFAULT"},
+	} {
+		request := core.NewRadiusRequest(core.ACCESS_REQUEST).Add(c.attrName, c.attrValue)
+		if clientType := detectRadiusClientType(request); clientType != c.clientType {
+			t.Errorf("client type for %s is %s, expected %s", c.attrName, clientType, c.clientType)
+		}
+	}
+}
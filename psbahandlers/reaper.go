@@ -0,0 +1,87 @@
+package psbahandlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Closes periodically the sessions for which the accounting is no longer received, typically because
+// the Stop was lost
+type SessionReaper struct {
+	ticker   *time.Ticker
+	doneChan chan struct{}
+}
+
+var sessionReaper *SessionReaper
+
+// Creates the reaper and starts the periodic checks
+func NewSessionReaper(checkSeconds int) *SessionReaper {
+	if checkSeconds <= 0 {
+		checkSeconds = 60
+	}
+
+	r := SessionReaper{
+		ticker:   time.NewTicker(time.Duration(checkSeconds) * time.Second),
+		doneChan: make(chan struct{}),
+	}
+	go r.loop()
+
+	return &r
+}
+
+// Stops the periodic checks
+func (r *SessionReaper) Close() {
+	r.ticker.Stop()
+	close(r.doneChan)
+}
+
+func (r *SessionReaper) loop() {
+	for {
+		select {
+		case <-r.doneChan:
+			return
+		case now := <-r.ticker.C:
+			reapSessions(now)
+		}
+	}
+}
+
+// Closes the sessions that are stale at the specified time
+func reapSessions(now time.Time) {
+
+	hc := handlerConfig.Get()
+	if hc.SessionReaperIntervalMultiple <= 0 {
+		return
+	}
+
+	for _, stale := range sessionStore.Stale(now, hc.SessionReaperIntervalMultiple, hc.SessionReaperDefaultIntervalSeconds) {
+		reapSession(stale)
+	}
+}
+
+// Closes the stale session with a synthetic Stop marked as "reaped", unless updated since it was found stale.
+// If so configured, the NAS is asked to disconnect the session first. If the NAS acknowledges, the session
+// is removed from the store when sending the Disconnect-Request, and the synthetic Stop is not written,
+// since the NAS sends its own
+func reapSession(stale Session) {
+
+	if handlerConfig.Get().SessionReaperDisconnect {
+		err := DisconnectSession(stale.AcctSessionId, stale.nas())
+		var nakErr *DynamicAuthorizationError
+		if err == nil {
+			core.GetLogger().Infof("stale session %s disconnected", stale.key())
+			return
+		} else if errors.As(err, &nakErr) && nakErr.ErrorCause == "Session-Context-Not-Found" {
+			// Already removed from the store
+			closeSession(&stale, "reaped", "Lost Service")
+			return
+		}
+		core.GetLogger().Debugf("disconnect of stale session %s failed: %s", stale.key(), err)
+	}
+
+	if session := sessionStore.RemoveIfNotUpdated(stale.AcctSessionId, stale.nas(), stale.LastUpdate); session != nil {
+		closeSession(session, "reaped", "Lost Service")
+	}
+}
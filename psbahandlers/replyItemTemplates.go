@@ -0,0 +1,181 @@
+package psbahandlers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+
+	"github.com/francistor/igor/core"
+)
+
+// Parsed reply item templates. The key is the template text. Only the attributes of the local configuration are
+// rendered, so the size is bounded by that configuration
+var replyItemTemplatesCache sync.Map
+
+// Placeholders for request variables, such as ${User-Name} or ${client.ExternalClientId:-unknown}
+var requestVariableRegex = regexp.MustCompile(`\$\{([^}:]+)(?::-([^}]*))?\}`)
+
+// Source of the values of the request variables that may be used in the reply items.
+// The variable names may be
+// - realm: the realm of the user
+// - plan: the plan assigned to the user, after applying the overrides
+// - client.<FieldName>: the value of the field in the client record, such as client.ExternalClientId. Only the
+// fields in clientVariables may be used
+// - otherwise, the name of an attribute of the request, such as User-Name or PSA-AccessId. Since those values are
+// sent by the NAS or the user, values with characters that could inject items, such as "=" and ";" in a
+// Cisco-AVPair, are not accepted
+type RequestVariables struct {
+	request  *core.RadiusPacket
+	realm    string
+	planName string
+	client   *ClientPoU
+}
+
+// Fields of the client record that may be used as request variables. Passwords and other
+// internal data are not available
+var clientVariables = map[string]func(c *ClientPoU) string{
+	"ClientId":            func(c *ClientPoU) string { return strconv.Itoa(c.ClientId) },
+	"ExternalClientId":    func(c *ClientPoU) string { return c.ExternalClientId },
+	"ISP":                 func(c *ClientPoU) string { return c.ISP },
+	"PlanName":            func(c *ClientPoU) string { return c.PlanName },
+	"BlockingStatus":      func(c *ClientPoU) string { return strconv.Itoa(c.BlockingStatus) },
+	"AccessId":            func(c *ClientPoU) string { return c.AccessId },
+	"AccessPort":          func(c *ClientPoU) string { return strconv.FormatInt(c.AccessPort, 10) },
+	"UserName":            func(c *ClientPoU) string { return c.UserName },
+	"IPv4Address":         func(c *ClientPoU) string { return c.IPv4Address },
+	"IPv6DelegatedPrefix": func(c *ClientPoU) string { return c.IPv6DelegatedPrefix },
+	"IPv6WANPrefix":       func(c *ClientPoU) string { return c.IPv6WANPrefix },
+	"AccessType":          func(c *ClientPoU) string { return strconv.Itoa(c.AccessType) },
+}
+
+// Characters that may not be present in the values taken from the request attributes
+const unsafeRequestValueChars = "=;"
+
+// Returns the value of the variable, or an empty string if not found. Returns an error if the value is
+// taken from the request and contains unsafe characters
+func (rv *RequestVariables) lookup(name string) (string, error) {
+	switch {
+	case name == "realm":
+		return rv.realm, nil
+	case name == "plan":
+		return rv.planName, nil
+	case strings.HasPrefix(name, "client."):
+		if rv.client == nil || rv.client.ClientId == 0 {
+			return "", nil
+		}
+		if accessor, found := clientVariables[name[len("client."):]]; found {
+			return accessor(rv.client), nil
+		}
+		return "", nil
+	default:
+		value := rv.request.GetStringAVP(name)
+		if strings.ContainsAny(value, unsafeRequestValueChars) || strings.IndexFunc(value, unicode.IsControl) != -1 {
+			return "", fmt.Errorf("unsafe value %q", value)
+		}
+		return value, nil
+	}
+}
+
+// Replaces the placeholders with the values of the variables. If the variable has no value, the default
+// specified as ${name:-default} is used, and if there is no default an error is returned. An error is also
+// returned if the value of a variable is not safe, even if there is a default
+func (rv *RequestVariables) expand(text string) (string, error) {
+	var missing []string
+	var lookupErr error
+	expanded := requestVariableRegex.ReplaceAllStringFunc(text, func(placeholder string) string {
+		m := requestVariableRegex.FindStringSubmatch(placeholder)
+		value, err := rv.lookup(m[1])
+		if err != nil {
+			if lookupErr == nil {
+				lookupErr = fmt.Errorf("variable %s: %w", m[1], err)
+			}
+			return ""
+		}
+		if value != "" {
+			return value
+		}
+		if strings.Contains(placeholder, ":-") {
+			return m[2]
+		}
+		missing = append(missing, m[1])
+		return ""
+	})
+
+	if lookupErr != nil {
+		return "", lookupErr
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no value for variables %s", strings.Join(missing, ","))
+	}
+
+	return expanded, nil
+}
+
+// Renders the values of the attributes that contain a template, such as {"Unisphere-Virtual-Router": "{{.VRF}}"},
+// using the specified parameters, and then expands the request variables, such as {"Filter-Id": "${realm}-in"}.
+// Attributes that cannot be rendered are removed from the list. Returns a new slice, so that the configuration
+// objects are not modified
+func renderReplyItems(avps []core.RadiusAVP, params PlanTemplateParams, variables *RequestVariables, hl *core.HandlerLogger) []core.RadiusAVP {
+
+	l := hl.L
+
+	rendered := make([]core.RadiusAVP, 0, len(avps))
+	for i := range avps {
+		text := avps[i].GetString()
+		isTemplate := strings.Contains(text, "{{")
+		hasVariables := strings.Contains(text, "${")
+		if !isTemplate && !hasVariables {
+			rendered = append(rendered, avps[i])
+			continue
+		}
+
+		value := text
+		var err error
+		if isTemplate {
+			if value, err = renderReplyItemTemplate(value, params); err != nil {
+				l.Warnf("removing attribute %s: could not render template %s: %s", avps[i].Name, text, err)
+				continue
+			}
+		}
+		if hasVariables {
+			if value, err = variables.expand(value); err != nil {
+				l.Errorf("removing attribute %s: could not expand %s: %s", avps[i].Name, text, err)
+				continue
+			}
+		}
+		avp, err := core.NewRadiusAVP(avps[i].Name, value)
+		if err != nil {
+			l.Warnf("removing attribute %s: bad value %s: %s", avps[i].Name, value, err)
+			continue
+		}
+		rendered = append(rendered, *avp)
+	}
+
+	return rendered
+}
+
+// Executes the template, parsing it only the first time it is found
+func renderReplyItemTemplate(text string, params PlanTemplateParams) (string, error) {
+
+	var tmpl *template.Template
+	if t, found := replyItemTemplatesCache.Load(text); found {
+		tmpl = t.(*template.Template)
+	} else {
+		var err error
+		if tmpl, err = template.New("replyItem").Funcs(planTemplateFuncs).Option("missingkey=error").Parse(text); err != nil {
+			return "", err
+		}
+		replyItemTemplatesCache.Store(text, tmpl)
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, params); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
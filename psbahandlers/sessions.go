@@ -0,0 +1,476 @@
+package psbahandlers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Active session, as reported by the accounting requests
+type Session struct {
+	AcctSessionId string
+	NASIPAddress  string
+	NASIdentifier string
+
+	UserName         string
+	AccessLine       string
+	MACAddress       string
+	RadiusClientType string
+
+	FramedIPAddress     string `json:",omitempty"`
+	FramedIPv6Prefix    string `json:",omitempty"`
+	DelegatedIPv6Prefix string `json:",omitempty"`
+
+	// Decoded from the Class attribute
+	PlanName         string `json:",omitempty"`
+	ExternalClientId string `json:",omitempty"`
+	ISP              string `json:",omitempty"`
+
+	// Active services, with their start time, as reported by service accounting
+	Services map[string]time.Time
+
+	StartTime  time.Time
+	LastUpdate time.Time
+
+	// Acct-Interim-Interval, if reported
+	InterimInterval int `json:",omitempty"`
+
+	// Counters, as reported in the last accounting request
+	SessionTime   int64
+	InputOctets   uint64
+	OutputOctets  uint64
+	InputPackets  uint64
+	OutputPackets uint64
+
+	// Last accounting request received for the session, used to generate synthetic stop CDRs
+	lastRequest *core.RadiusPacket
+}
+
+// Returns the key of the session in the store
+func (s *Session) key() string {
+	return sessionKey(s.AcctSessionId, s.nas())
+}
+
+// Returns the NAS-IP-Address or, if not reported, the NAS-Identifier
+func (s *Session) nas() string {
+	if s.NASIPAddress != "" {
+		return s.NASIPAddress
+	}
+	return s.NASIdentifier
+}
+
+func sessionKey(acctSessionId string, nas string) string {
+	return acctSessionId + "@" + nas
+}
+
+// Values of the session by which it may be looked for
+var sessionIndexes = map[string]func(s *Session) []string{
+	"userName":   func(s *Session) []string { return []string{s.UserName} },
+	"clientId":   func(s *Session) []string { return []string{s.ExternalClientId} },
+	"accessLine": func(s *Session) []string { return []string{s.AccessLine} },
+	"nas":        func(s *Session) []string { return []string{s.NASIPAddress, s.NASIdentifier} },
+	"ip": func(s *Session) []string {
+		return []string{s.FramedIPAddress, s.FramedIPv6Prefix, s.DelegatedIPv6Prefix}
+	},
+}
+
+// Table of active sessions, updated with the accounting requests. Not persisted
+type SessionStore struct {
+	sync.Mutex
+
+	// The key is <Acct-Session-Id>@<NAS>
+	sessions map[string]*Session
+
+	// The key is the index name, then the value, then the session key
+	indexes map[string]map[string]map[string]*Session
+}
+
+var sessionStore *SessionStore
+
+// Creates the session store
+func NewSessionStore() *SessionStore {
+	indexes := make(map[string]map[string]map[string]*Session)
+	for indexName := range sessionIndexes {
+		indexes[indexName] = make(map[string]map[string]*Session)
+	}
+
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+		indexes:  indexes,
+	}
+}
+
+// Updates the session store with the accounting request. Start and Interim-Update create or update the
+// session, and Stop removes it. The service accounting requests update the services of the session.
+// Returns the session, or nil if not found
+func (s *SessionStore) Update(request *core.RadiusPacket, ctx *RequestContext, serviceName string) *Session {
+
+	acctSessionId := request.GetStringAVP("Acct-Session-Id")
+	nas := request.GetStringAVP("NAS-IP-Address")
+	if nas == "" {
+		nas = request.GetStringAVP("NAS-Identifier")
+	}
+	if acctSessionId == "" || nas == "" {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	statusType := request.GetStringAVP("Acct-Status-Type")
+	if serviceName != "" {
+		session := s.parentSession(request, ctx.accessLine(), nas)
+		if session != nil {
+			switch statusType {
+			case "Start", "Interim-Update":
+				if _, found := session.Services[serviceName]; !found {
+					session.Services[serviceName] = time.Now()
+				}
+			case "Stop":
+				delete(session.Services, serviceName)
+			}
+		}
+		return session
+	}
+
+	key := sessionKey(acctSessionId, nas)
+	session, found := s.sessions[key]
+
+	switch statusType {
+	case "Start", "Interim-Update":
+		if found {
+			s.unindex(session)
+		} else {
+			session = &Session{
+				AcctSessionId: acctSessionId,
+				Services:      make(map[string]time.Time),
+				StartTime:     time.Now(),
+			}
+			if sessionTime := request.GetIntAVP("Acct-Session-Time"); sessionTime > 0 {
+				// Start of the session was not seen
+				session.StartTime = session.StartTime.Add(-time.Duration(sessionTime) * time.Second)
+			}
+			s.sessions[key] = session
+		}
+		session.fill(request, ctx)
+		s.index(session)
+
+	case "Stop":
+		if found {
+			// Unindexed with the previous values, which may be changed by the Stop
+			s.unindex(session)
+			session.fill(request, ctx)
+			delete(s.sessions, key)
+		}
+	}
+
+	return session
+}
+
+// Removes and returns the session. Returns nil if not found
+func (s *SessionStore) Remove(acctSessionId string, nas string) *Session {
+	s.Lock()
+	defer s.Unlock()
+
+	session, found := s.sessions[sessionKey(acctSessionId, nas)]
+	if !found {
+		return nil
+	}
+	s.remove(session)
+
+	return session
+}
+
+// Removes and returns all the sessions of the NAS, identified by NAS-IP-Address or, if empty, by NAS-Identifier
+func (s *SessionStore) RemoveNAS(nasIPAddress string, nasIdentifier string) []*Session {
+	s.Lock()
+	defer s.Unlock()
+
+	var removed []*Session
+	for _, session := range s.indexes["nas"][nasIPAddress] {
+		removed = append(removed, session)
+	}
+	if nasIPAddress == "" {
+		for _, session := range s.indexes["nas"][nasIdentifier] {
+			removed = append(removed, session)
+		}
+	}
+	for _, session := range removed {
+		s.remove(session)
+	}
+
+	return removed
+}
+
+// Removes and returns the session only if it has not been updated since the specified time, so that an
+// accounting request received in the meanwhile is not lost. Returns nil otherwise
+func (s *SessionStore) RemoveIfNotUpdated(acctSessionId string, nas string, lastUpdate time.Time) *Session {
+	s.Lock()
+	defer s.Unlock()
+
+	session, found := s.sessions[sessionKey(acctSessionId, nas)]
+	if !found || !session.LastUpdate.Equal(lastUpdate) {
+		return nil
+	}
+	s.remove(session)
+
+	return session
+}
+
+// Returns copies of the sessions not updated during the specified multiple of their Acct-Interim-Interval,
+// or of the default interval if not reported. Sessions without interval are never stale
+func (s *SessionStore) Stale(now time.Time, multiple int, defaultIntervalSeconds int) []Session {
+	s.Lock()
+	defer s.Unlock()
+
+	var stale []Session
+	for _, session := range s.sessions {
+		interval := session.InterimInterval
+		if interval == 0 {
+			interval = defaultIntervalSeconds
+		}
+		if interval == 0 {
+			continue
+		}
+		if now.Sub(session.LastUpdate) > time.Duration(multiple*interval)*time.Second {
+			stale = append(stale, session.copy())
+		}
+	}
+
+	return stale
+}
+
+// Returns a copy of the session. Returns false if not found
+func (s *SessionStore) Get(acctSessionId string, nas string) (Session, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if session, found := s.sessions[sessionKey(acctSessionId, nas)]; found {
+		return session.copy(), true
+	}
+	return Session{}, false
+}
+
+// Returns copies of the sessions whose indexed value is the one specified, sorted by start time. If the
+// index name is empty, all the sessions are returned. Returns also the total number of sessions found, of
+// which only limit, starting at offset, are returned. If limit is zero, all of them are returned
+func (s *SessionStore) Find(indexName string, value string, offset int, limit int) ([]Session, int) {
+	s.Lock()
+
+	var found []*Session
+	if indexName == "" {
+		found = make([]*Session, 0, len(s.sessions))
+		for _, session := range s.sessions {
+			found = append(found, session)
+		}
+	} else {
+		for _, session := range s.indexes[indexName][value] {
+			found = append(found, session)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].StartTime.Equal(found[j].StartTime) {
+			return found[i].key() < found[j].key()
+		}
+		return found[i].StartTime.Before(found[j].StartTime)
+	})
+
+	total := len(found)
+	if offset > total {
+		offset = total
+	}
+	found = found[offset:]
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	sessions := make([]Session, len(found))
+	for i := range found {
+		sessions[i] = found[i].copy()
+	}
+	s.Unlock()
+
+	return sessions, total
+}
+
+// Returns the number of active sessions
+func (s *SessionStore) Count() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.sessions)
+}
+
+// Finds the session to which a service accounting request belongs, using the Acct-Multi-Session-Id if
+// present, or otherwise the most recent session of the access line in the same NAS. Must be called with
+// the lock held
+func (s *SessionStore) parentSession(request *core.RadiusPacket, accessLine string, nas string) *Session {
+	if multiSessionId := request.GetStringAVP("Acct-Multi-Session-Id"); multiSessionId != "" {
+		if session, found := s.sessions[sessionKey(multiSessionId, nas)]; found {
+			return session
+		}
+	}
+
+	var parent *Session
+	for _, session := range s.indexes["accessLine"][accessLine] {
+		if session.nas() == nas && (parent == nil || session.StartTime.After(parent.StartTime)) {
+			parent = session
+		}
+	}
+	return parent
+}
+
+// Must be called with the lock held
+func (s *SessionStore) remove(session *Session) {
+	s.unindex(session)
+	delete(s.sessions, session.key())
+}
+
+// Must be called with the lock held
+func (s *SessionStore) index(session *Session) {
+	for indexName, values := range sessionIndexes {
+		for _, value := range values(session) {
+			if value == "" {
+				continue
+			}
+			if s.indexes[indexName][value] == nil {
+				s.indexes[indexName][value] = make(map[string]*Session)
+			}
+			s.indexes[indexName][value][session.key()] = session
+		}
+	}
+}
+
+// Must be called with the lock held
+func (s *SessionStore) unindex(session *Session) {
+	for indexName, values := range sessionIndexes {
+		for _, value := range values(session) {
+			delete(s.indexes[indexName][value], session.key())
+			if len(s.indexes[indexName][value]) == 0 {
+				delete(s.indexes[indexName], value)
+			}
+		}
+	}
+}
+
+// Updates the session with the values in the accounting request
+func (session *Session) fill(request *core.RadiusPacket, ctx *RequestContext) {
+	session.NASIPAddress = request.GetStringAVP("NAS-IP-Address")
+	session.NASIdentifier = request.GetStringAVP("NAS-Identifier")
+	session.UserName = ctx.userName
+	session.AccessLine = ctx.accessLine()
+	session.MACAddress = ctx.macAddress
+	session.RadiusClientType = ctx.radiusClientType
+
+	if v := request.GetStringAVP("Framed-IP-Address"); v != "" {
+		session.FramedIPAddress = v
+	}
+	if v := request.GetStringAVP("Framed-IPv6-Prefix"); v != "" {
+		session.FramedIPv6Prefix = v
+	}
+	if v := request.GetStringAVP("Delegated-IPv6-Prefix"); v != "" {
+		session.DelegatedIPv6Prefix = v
+	}
+	if v := request.GetStringAVP("PSA-PlanName"); v != "" {
+		session.PlanName = v
+	}
+	if v := request.GetStringAVP("PSA-ExternalClientId"); v != "" {
+		session.ExternalClientId = v
+	}
+	if v := request.GetStringAVP("PSA-ISP"); v != "" {
+		session.ISP = v
+	}
+	if v := request.GetIntAVP("Acct-Interim-Interval"); v > 0 {
+		session.InterimInterval = int(v)
+	}
+
+	session.SessionTime = request.GetIntAVP("Acct-Session-Time")
+	session.InputOctets = octetsWithGigawords(request, "Acct-Input-Octets", "Acct-Input-Gigawords")
+	session.OutputOctets = octetsWithGigawords(request, "Acct-Output-Octets", "Acct-Output-Gigawords")
+	session.InputPackets = uint64(request.GetIntAVP("Acct-Input-Packets"))
+	session.OutputPackets = uint64(request.GetIntAVP("Acct-Output-Packets"))
+
+	session.LastUpdate = time.Now()
+	session.lastRequest = request
+}
+
+// Returns a copy of the session that can be used without holding the lock
+func (session *Session) copy() Session {
+	c := *session
+	c.Services = make(map[string]time.Time, len(session.Services))
+	for name, start := range session.Services {
+		c.Services[name] = start
+	}
+	return c
+}
+
+// Treats a session closed without a Stop from the NAS as if the Stop had been received, releasing the
+// leases and writing the CDRs. The synthetic Stop is built from the last accounting request of the session,
+// with the specified Acct-Terminate-Cause, and the reason in the PSA-SessionCloseReason attribute
+func closeSession(session *Session, reason string, terminateCause string) {
+
+	hl := core.NewHandlerLogger()
+	defer hl.WriteLog()
+	l := hl.L
+
+	stop := session.lastRequest.Copy(nil, []string{"Acct-Status-Type", "Acct-Terminate-Cause", "Acct-Delay-Time", "Event-Timestamp", "PSA-SessionCloseReason"}).
+		Add("Acct-Status-Type", "Stop").
+		Add("Acct-Terminate-Cause", terminateCause).
+		Add("PSA-SessionCloseReason", reason)
+
+	ctx := newRequestContext(stop, hl)
+	if isp := stop.GetStringAVP("PSA-ISP"); isp != "" {
+		ctx.applyISP(isp, hl)
+	}
+
+	updateLeases(stop, ctx.accessLine(), hl)
+	writeCDRs(stop, &ctx, hl)
+	accountingSink.Add(stop, &ctx)
+
+	incrementCounter("sessionsClosed", reason)
+	l.Infof("session %s of %s closed: %s", session.key(), session.UserName, reason)
+}
+
+// Returns the value of the counter, taking into account the wraps reported in the gigawords attribute
+func octetsWithGigawords(request *core.RadiusPacket, octetsName string, gigawordsName string) uint64 {
+	return uint64(request.GetIntAVP(gigawordsName))<<32 + uint64(request.GetIntAVP(octetsName))
+}
+
+// Page of sessions returned by the administrative API
+type SessionsPage struct {
+	Total    int
+	Offset   int
+	Sessions []Session
+}
+
+// Returns the sessions that match one of the "userName", "clientId", "ip", "nas" or "accessLine" query
+// parameters, or all if none specified, with pagination specified by the "offset" and "limit" parameters.
+// The limit defaults to 100
+func sessionsAdminHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	var indexName, value string
+	for name := range sessionIndexes {
+		if v := query.Get(name); v != "" {
+			indexName, value = name, v
+			break
+		}
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit := 100
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	sessions, total := sessionStore.Find(indexName, value, offset, limit)
+	writeJSONResponse(w, SessionsPage{Total: total, Offset: offset, Sessions: sessions})
+}
@@ -0,0 +1,117 @@
+package psbahandlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestSessionStore(t *testing.T) {
+
+	store := NewSessionStore()
+	ctx := RequestContext{userName: "user@realm", accessId: "line1", accessPort: 1, radiusClientType: "HUAWEI"}
+
+	request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Acct-Session-Id", "session-1").
+		Add("Acct-Status-Type", "Start").
+		Add("Framed-IP-Address", "10.0.0.1").
+		Add("Class", "P:Plan1#C:ExternalUser").
+		Add("PSA-PlanName", "Plan1").
+		Add("PSA-ExternalClientId", "ExternalUser")
+	if session := store.Update(request, &ctx, ""); session == nil {
+		t.Fatal("session not created")
+	}
+
+	// Counters with gigawords
+	interim := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Acct-Session-Id", "session-1").
+		Add("Acct-Status-Type", "Interim-Update").
+		Add("Acct-Session-Time", 300).
+		Add("Acct-Input-Octets", 10).
+		Add("Acct-Input-Gigawords", 1)
+	store.Update(interim, &ctx, "")
+
+	session, found := store.Get("session-1", "127.0.0.1")
+	if !found {
+		t.Fatal("session not found")
+	}
+	if session.InputOctets != 1<<32+10 || session.SessionTime != 300 {
+		t.Errorf("bad counters %d %d", session.InputOctets, session.SessionTime)
+	}
+	if session.PlanName != "Plan1" || session.FramedIPAddress != "10.0.0.1" {
+		t.Errorf("values of the start not kept %#v", session)
+	}
+
+	// Service accounting updates the parent session
+	service := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Acct-Session-Id", "service-1").
+		Add("Acct-Status-Type", "Start")
+	if store.Update(service, &ctx, "basic"); store.Count() != 1 {
+		t.Errorf("service accounting created a session")
+	}
+	if session, _ = store.Get("session-1", "127.0.0.1"); len(session.Services) != 1 {
+		t.Errorf("service not added %v", session.Services)
+	}
+
+	// Queries
+	for _, query := range []struct{ index, value string }{{"userName", "user@realm"}, {"clientId", "ExternalUser"}, {"ip", "10.0.0.1"}, {"nas", "127.0.0.1"}, {"accessLine", "line1:1"}} {
+		if sessions, total := store.Find(query.index, query.value, 0, 0); total != 1 || len(sessions) != 1 {
+			t.Errorf("session not found by %s", query.index)
+		}
+	}
+
+	// Pagination
+	ctx2 := ctx
+	ctx2.accessPort = 2
+	for _, id := range []string{"session-2", "session-3"} {
+		store.Update(core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+			Add("NAS-IP-Address", "127.0.0.1").
+			Add("Acct-Session-Id", id).
+			Add("Acct-Status-Type", "Start"), &ctx2, "")
+	}
+	if sessions, total := store.Find("userName", "user@realm", 1, 1); total != 3 || len(sessions) != 1 {
+		t.Errorf("bad page %d %v", total, sessions)
+	}
+	if sessions, _ := store.Find("", "", 5, 10); len(sessions) != 0 {
+		t.Errorf("sessions beyond the last one %v", sessions)
+	}
+
+	// Stop removes the session and the indexes
+	stop := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Acct-Session-Id", "session-1").
+		Add("Acct-Status-Type", "Stop").
+		Add("Framed-IP-Address", "10.0.0.2")
+	store.Update(stop, &ctx, "")
+	if _, found := store.Get("session-1", "127.0.0.1"); found {
+		t.Error("session not removed")
+	}
+	if _, total := store.Find("ip", "10.0.0.1", 0, 0); total != 0 {
+		t.Error("index not cleaned")
+	}
+
+	// Stale sessions
+	interim.Add("Acct-Interim-Interval", 60)
+	store.Update(interim, &ctx, "")
+	session, _ = store.Get("session-1", "127.0.0.1")
+	if stale := store.Stale(session.LastUpdate.Add(179*time.Second), 3, 0); len(stale) != 0 {
+		t.Errorf("session stale too early %v", stale)
+	}
+	if stale := store.Stale(session.LastUpdate.Add(181*time.Second), 3, 0); len(stale) != 1 {
+		t.Errorf("session not stale %v", stale)
+	}
+	// The other sessions did not report the interval
+	if stale := store.Stale(session.LastUpdate.Add(24*time.Hour), 3, 0); len(stale) != 1 {
+		t.Errorf("sessions without interval reported as stale %v", stale)
+	}
+	if store.RemoveIfNotUpdated("session-1", "127.0.0.1", session.LastUpdate.Add(-time.Second)) != nil {
+		t.Error("updated session removed")
+	}
+	if store.RemoveIfNotUpdated("session-1", "127.0.0.1", session.LastUpdate) == nil {
+		t.Error("stale session not removed")
+	}
+}
@@ -0,0 +1,381 @@
+package psbahandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Copy of an accounting request stored in the spool
+type SpoolRecord struct {
+	Timestamp time.Time
+	AVPs      []core.RadiusAVP
+}
+
+// Status of a spool, as reported in the administrative API
+type SpoolStatus struct {
+	Records int
+	Bytes   int64
+	Oldest  *time.Time `json:",omitempty"`
+}
+
+type spoolEntry struct {
+	fileName string
+	size     int64
+	created  time.Time
+}
+
+// Stores on disk the copies that could not be sent to a copy target, one file per record, and sends
+// them again, in the same order, when the target recovers. While there are records in the spool, new
+// copies are also spooled, so that they are not sent before the older ones
+type Spool struct {
+	sync.Mutex
+
+	target    CopyTarget
+	directory string
+
+	// Oldest first
+	entries []spoolEntry
+	bytes   int64
+	nextSeq uint64
+
+	ticker   *time.Ticker
+	doneChan chan struct{}
+}
+
+// The key is the name of the copy target
+var copySpools map[string]*Spool
+
+// Spools for the inline accounting proxy, created when first used, since the proxy groups may be specified
+// in the realm or client configuration. The key is the name of the spool target, which includes the proxy group
+// and the timeout and retries, so that the requests are sent again with the settings of the realm that spooled them
+type proxySpoolRegistry struct {
+	sync.Mutex
+	spools map[string]*Spool
+}
+
+var proxySpools = proxySpoolRegistry{spools: make(map[string]*Spool)}
+
+// Returns the spool for the proxy group in the configuration, creating it if necessary
+func (r *proxySpoolRegistry) get(config HandlerConfig) (*Spool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	targetName := fmt.Sprintf("proxy-%s-%d-%d-%d", config.ProxyGroupName, config.ProxyTimeoutMillis, config.ProxyRetries, config.ProxyServerRetries)
+	if spool, found := r.spools[targetName]; found {
+		return spool, nil
+	}
+
+	if config.SpoolDirectory == "" {
+		return nil, fmt.Errorf("no SpoolDirectory for the spool of %s", config.ProxyGroupName)
+	}
+
+	target := CopyTarget{
+		TargetName:         targetName,
+		ProxyGroupName:     config.ProxyGroupName,
+		ProxyTimeoutMillis: config.ProxyTimeoutMillis,
+		ProxyRetries:       config.ProxyRetries,
+		ProxyServerRetries: config.ProxyServerRetries,
+	}
+	spool, err := NewSpool(filepath.Join(config.SpoolDirectory, target.TargetName), target, config.SpoolRetrySeconds)
+	if err != nil {
+		return nil, err
+	}
+	r.spools[targetName] = spool
+
+	return spool, nil
+}
+
+// Returns the spools of the copy targets and of the inline proxy, indexed by target name
+func allSpools() map[string]*Spool {
+	proxySpools.Lock()
+	defer proxySpools.Unlock()
+
+	spools := make(map[string]*Spool, len(copySpools)+len(proxySpools.spools))
+	for name, spool := range copySpools {
+		spools[name] = spool
+	}
+	for name, spool := range proxySpools.spools {
+		spools[name] = spool
+	}
+	return spools
+}
+
+// Stops the replay of all the spools
+func closeSpools() {
+	for _, spool := range allSpools() {
+		spool.Close()
+	}
+}
+
+// Creates the spool for the copy target in the specified directory, loading the records already there,
+// and starts the periodic replay
+func NewSpool(directory string, target CopyTarget, retrySeconds int) (*Spool, error) {
+	if retrySeconds <= 0 {
+		retrySeconds = 10
+	}
+
+	s := Spool{
+		target:    target,
+		directory: directory,
+		doneChan:  make(chan struct{}),
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("could not create spool directory for %s: %w", target.TargetName, err)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.ticker = time.NewTicker(time.Duration(retrySeconds) * time.Second)
+	go s.loop()
+
+	return &s, nil
+}
+
+// Stops the periodic replay. The records are kept on disk
+func (s *Spool) Close() {
+	s.ticker.Stop()
+	close(s.doneChan)
+}
+
+// Whether there are records waiting to be sent
+func (s *Spool) Pending() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.entries) > 0
+}
+
+// Stores the request as the newest record, discarding the oldest ones if the size limit is exceeded
+func (s *Spool) Add(request *core.RadiusPacket) error {
+	now := time.Now()
+	jBytes, err := json.Marshal(SpoolRecord{Timestamp: now, AVPs: request.AVPs})
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	fileName := fmt.Sprintf("%020d.json", s.nextSeq)
+	tmpFile := filepath.Join(s.directory, fileName+".tmp")
+	if err := os.WriteFile(tmpFile, jBytes, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, filepath.Join(s.directory, fileName)); err != nil {
+		return err
+	}
+	s.nextSeq++
+
+	s.entries = append(s.entries, spoolEntry{fileName: fileName, size: int64(len(jBytes)), created: now})
+	s.bytes += int64(len(jBytes))
+	incrementCounter("spooled", s.target.TargetName)
+
+	for s.target.SpoolMaxBytes > 0 && s.bytes > s.target.SpoolMaxBytes && len(s.entries) > 1 {
+		s.removeOldest()
+		incrementCounter("spoolDropped", s.target.TargetName)
+	}
+
+	return nil
+}
+
+// Returns the number of records, total size and creation time of the oldest record
+func (s *Spool) Status() SpoolStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	status := SpoolStatus{Records: len(s.entries), Bytes: s.bytes}
+	if len(s.entries) > 0 {
+		oldest := s.entries[0].created
+		status.Oldest = &oldest
+	}
+	return status
+}
+
+// Returns up to limit records, oldest first
+func (s *Spool) Records(limit int) ([]SpoolRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	records := make([]SpoolRecord, 0)
+	for i := 0; i < len(s.entries) && i < limit; i++ {
+		record, err := s.read(s.entries[i])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Removes all the records. Returns the number of records removed
+func (s *Spool) Purge() int {
+	s.Lock()
+	defer s.Unlock()
+
+	purged := len(s.entries)
+	for len(s.entries) > 0 {
+		s.removeOldest()
+	}
+	return purged
+}
+
+func (s *Spool) loop() {
+	for {
+		select {
+		case <-s.doneChan:
+			return
+		case <-s.ticker.C:
+			s.replay()
+		}
+	}
+}
+
+// Discards the records older than the maximum age and sends the rest in order, stopping at the first
+// failure, which is retried in the next tick
+func (s *Spool) replay() {
+
+	if s.target.SpoolMaxAgeSeconds > 0 {
+		s.Lock()
+		for len(s.entries) > 0 && time.Since(s.entries[0].created) > time.Duration(s.target.SpoolMaxAgeSeconds)*time.Second {
+			s.removeOldest()
+			incrementCounter("spoolDropped", s.target.TargetName)
+		}
+		s.Unlock()
+	}
+
+	for {
+		s.Lock()
+		if len(s.entries) == 0 {
+			s.Unlock()
+			return
+		}
+		entry := s.entries[0]
+		record, err := s.read(entry)
+		s.Unlock()
+
+		if err != nil {
+			// Unreadable records are discarded, so as not to block the spool
+			core.GetLogger().Errorf("discarding spool record %s for %s: %s", entry.fileName, s.target.TargetName, err)
+		} else {
+			request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).AddAVPs(record.AVPs)
+			if _, err := radiusRouter.RouteRadiusRequest(request, s.target.ProxyGroupName, time.Duration(s.target.ProxyTimeoutMillis)*time.Millisecond, 1+s.target.ProxyRetries, 1+s.target.ProxyServerRetries, ""); err != nil {
+				core.GetLogger().Debugf("replay of spool for %s failed: %s", s.target.TargetName, err)
+				return
+			}
+			incrementCounter("spoolReplayed", s.target.TargetName)
+		}
+
+		// The spool may have been purged in the meanwhile
+		s.Lock()
+		if len(s.entries) > 0 && s.entries[0].fileName == entry.fileName {
+			s.removeOldest()
+		}
+		s.Unlock()
+	}
+}
+
+// Reads the records in the directory, ordered by sequence number. Must be called before starting the replay
+func (s *Spool) load() error {
+	dirEntries, err := os.ReadDir(s.directory)
+	if err != nil {
+		return fmt.Errorf("could not read spool directory for %s: %w", s.target.TargetName, err)
+	}
+
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".json") {
+			// Temporary files of interrupted writes
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		s.entries = append(s.entries, spoolEntry{fileName: name, size: info.Size(), created: info.ModTime()})
+		s.bytes += info.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].fileName < s.entries[j].fileName })
+
+	return nil
+}
+
+// Must be called with the lock held
+func (s *Spool) read(entry spoolEntry) (SpoolRecord, error) {
+	var record SpoolRecord
+	jBytes, err := os.ReadFile(filepath.Join(s.directory, entry.fileName))
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(jBytes, &record)
+	return record, err
+}
+
+// Must be called with the lock held
+func (s *Spool) removeOldest() {
+	entry := s.entries[0]
+	if err := os.Remove(filepath.Join(s.directory, entry.fileName)); err != nil && !os.IsNotExist(err) {
+		core.GetLogger().Errorf("could not remove spool record %s for %s: %s", entry.fileName, s.target.TargetName, err)
+	}
+	s.entries = s.entries[1:]
+	s.bytes -= entry.size
+}
+
+// Returns the status of the spools of the copy targets and of the inline proxy, the latter named
+// "proxy-<group>-<timeout millis>-<retries>-<server retries>". If the "target" query parameter is specified, returns the oldest records
+// of the spool of that target, up to the value of the "limit" parameter, which defaults to 100. With POST, the
+// spool of the target is purged
+func spoolsAdminHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	targetName := query.Get("target")
+	spools := allSpools()
+
+	if targetName == "" {
+		status := make(map[string]SpoolStatus)
+		for name, spool := range spools {
+			status[name] = spool.Status()
+		}
+		writeJSONResponse(w, status)
+		return
+	}
+
+	spool, found := spools[targetName]
+	if !found {
+		http.Error(w, "no spool for target "+targetName, http.StatusNotFound)
+		return
+	}
+
+	if req.Method == http.MethodPost {
+		purged := spool.Purge()
+		core.GetLogger().Infof("spool for %s purged, %d records removed", targetName, purged)
+		writeJSONResponse(w, map[string]int{"purged": purged})
+		return
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	records, err := spool.Records(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, records)
+}
@@ -0,0 +1,93 @@
+package psbahandlers
+
+import (
+	"testing"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestSpool(t *testing.T) {
+
+	directory := t.TempDir()
+	target := CopyTarget{TargetName: "test-copy"}
+
+	// The replay is not done during the test
+	spool, err := NewSpool(directory, target, 3600)
+	if err != nil {
+		t.Fatalf("could not create spool: %s", err)
+	}
+	for _, userName := range []string{"user1", "user2", "user3"} {
+		if err := spool.Add(core.NewRadiusRequest(core.ACCOUNTING_REQUEST).Add("User-Name", userName)); err != nil {
+			t.Fatalf("could not add to spool: %s", err)
+		}
+	}
+	status := spool.Status()
+	if status.Records != 3 || status.Bytes == 0 || status.Oldest == nil {
+		t.Errorf("bad spool status %v", status)
+	}
+	spool.Close()
+
+	// The records are kept on disk, in order
+	spool, err = NewSpool(directory, target, 3600)
+	if err != nil {
+		t.Fatalf("could not reload spool: %s", err)
+	}
+	records, err := spool.Records(2)
+	if err != nil {
+		t.Fatalf("could not get records: %s", err)
+	}
+	if len(records) != 2 || records[0].AVPs[0].GetString() != "user1" || records[1].AVPs[0].GetString() != "user2" {
+		t.Errorf("bad records %v", records)
+	}
+	if err := spool.Add(core.NewRadiusRequest(core.ACCOUNTING_REQUEST).Add("User-Name", "user4")); err != nil {
+		t.Fatalf("could not add to reloaded spool: %s", err)
+	}
+	if records, _ := spool.Records(10); len(records) != 4 || records[3].AVPs[0].GetString() != "user4" {
+		t.Errorf("bad records after reload %v", records)
+	}
+
+	if purged := spool.Purge(); purged != 4 || spool.Pending() {
+		t.Errorf("spool not purged %d", purged)
+	}
+	spool.Close()
+
+	// Oldest records discarded when the size is exceeded
+	target.SpoolMaxBytes = 1
+	spool, err = NewSpool(directory, target, 3600)
+	if err != nil {
+		t.Fatalf("could not create spool: %s", err)
+	}
+	defer spool.Close()
+	for _, userName := range []string{"user1", "user2"} {
+		spool.Add(core.NewRadiusRequest(core.ACCOUNTING_REQUEST).Add("User-Name", userName))
+	}
+	if records, _ := spool.Records(10); len(records) != 1 || records[0].AVPs[0].GetString() != "user2" {
+		t.Errorf("oldest record not discarded %v", records)
+	}
+}
+
+func TestProxySpoolRegistry(t *testing.T) {
+
+	registry := proxySpoolRegistry{spools: make(map[string]*Spool)}
+	config := HandlerConfig{ProxyGroupName: "group1", ProxyTimeoutMillis: 1000, ProxyRetries: 1, SpoolDirectory: t.TempDir(), SpoolRetrySeconds: 3600}
+
+	spool1, err := registry.get(config)
+	if err != nil {
+		t.Fatalf("could not create spool: %s", err)
+	}
+	defer spool1.Close()
+	if again, _ := registry.get(config); again != spool1 {
+		t.Error("spool not reused for the same settings")
+	}
+
+	// Same proxy group with different settings
+	config.ProxyTimeoutMillis = 5000
+	spool2, err := registry.get(config)
+	if err != nil {
+		t.Fatalf("could not create spool: %s", err)
+	}
+	defer spool2.Close()
+	if spool2 == spool1 || spool1.target.ProxyTimeoutMillis != 1000 || spool2.target.ProxyTimeoutMillis != 5000 {
+		t.Errorf("spools not separated by settings %v %v", spool1.target, spool2.target)
+	}
+}